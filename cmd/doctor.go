@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"github.com/nwtgck/go-webrtc-piping/doctor"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func init() {
+	RootCmd.AddCommand(DoctorCmd)
+}
+
+var DoctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose Piping Server, STUN, TURN and NAT",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		proxyFunc, err := createProxyFunc(flags.proxy)
+		if err != nil {
+			return err
+		}
+		httpClient := createHttpClient(flags.insecure, flags.dnsServer, proxyFunc)
+		httpHeaders, err := parseHeaderKeyValueStrs(flags.httpHeaderKeyValueStrs)
+		if err != nil {
+			return err
+		}
+		webrtcConfig, err := createWebrtcConfig(httpClient)
+		if err != nil {
+			return err
+		}
+		return doctor.Run(os.Stdout, httpClient, flags.pipingServerUrl, httpHeaders, webrtcConfig.ICEServers, newIceProxyDialer(proxyFunc, nil, flags.insecure))
+	},
+}
@@ -30,16 +30,33 @@ var DuplexCmd = &cobra.Command{
 		} else {
 			logger = log.New(io.Discard, "", 0)
 		}
-		httpClient := createHttpClient(flags.insecure, flags.dnsServer)
+		pathLogger := createPathLogger(logger)
+
+		proxyFunc, err := createProxyFunc(flags.proxy)
+		if err != nil {
+			return err
+		}
+		httpClient := createHttpClient(flags.insecure, flags.dnsServer, proxyFunc)
 		httpHeaders, err := parseHeaderKeyValueStrs(flags.httpHeaderKeyValueStrs)
 		if err != nil {
 			return err
 		}
-		webrtcConfig := createWebrtcConfig()
+		webrtcConfig, err := createWebrtcConfig(httpClient)
+		if err != nil {
+			return err
+		}
+		settingEngine, err := createSettingEngine(proxyFunc, webrtcConfig.ICEServers)
+		if err != nil {
+			return err
+		}
+		candidateTypes, err := parseCandidateTypes(flags.candidateTypes)
+		if err != nil {
+			return err
+		}
 		if localId < remoteId {
-			return duplex.HandleOffer(logger, httpClient, flags.pipingServerUrl, httpHeaders, localId, remoteId, webrtcConfig)
+			return duplex.HandleOffer(logger, pathLogger, createResolver(flags.dnsServer), httpClient, flags.pipingServerUrl, httpHeaders, localId, remoteId, settingEngine, webrtcConfig, candidateTypes)
 		} else {
-			return duplex.HandleAnswer(logger, httpClient, flags.pipingServerUrl, httpHeaders, localId, remoteId, webrtcConfig)
+			return duplex.HandleAnswer(logger, pathLogger, createResolver(flags.dnsServer), httpClient, flags.pipingServerUrl, httpHeaders, localId, remoteId, settingEngine, webrtcConfig, candidateTypes)
 		}
 	},
 }
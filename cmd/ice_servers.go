@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pion/ice/v2"
+	"github.com/spf13/pflag"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// iceServersFlag accepts JSON or "@" followed by URL or file path of JSON
+type iceServersFlag struct {
+	servers *[]iceServerFlag
+	source  *string
+}
+
+var _ pflag.Value = (*iceServersFlag)(nil)
+
+func (f *iceServersFlag) Set(s string) error {
+	if strings.HasPrefix(s, "@") {
+		*f.source = strings.TrimPrefix(s, "@")
+		return nil
+	}
+	*f.source = ""
+	return json.Unmarshal([]byte(s), f.servers)
+}
+
+func (f *iceServersFlag) Type() string {
+	return "json"
+}
+
+func (f *iceServersFlag) String() string {
+	if *f.source != "" {
+		return "@" + *f.source
+	}
+	return (&JSONFlag{Value: f.servers}).String()
+}
+
+// loadIceServers returns ICE servers in priority order of --ice-servers, --ice-servers-file, env and the default
+func loadIceServers(httpClient *http.Client) ([]iceServerFlag, error) {
+	iceServersChanged := RootCmd.PersistentFlags().Changed("ice-servers")
+	if iceServersChanged && flags.iceServersFile != "" {
+		return nil, fmt.Errorf("--ice-servers and --ice-servers-file cannot be specified together")
+	}
+	var iceServers []iceServerFlag
+	var err error
+	switch {
+	case iceServersChanged && flags.iceServersSource != "":
+		iceServers, err = readIceServersSource(httpClient, flags.iceServersSource)
+	case iceServersChanged:
+		iceServers = flags.iceServers
+	case flags.iceServersFile != "":
+		iceServers, err = readIceServersSource(httpClient, flags.iceServersFile)
+	default:
+		envValue, ok := os.LookupEnv(IceServersEnvName)
+		if !ok {
+			iceServers = flags.iceServers
+			break
+		}
+		if strings.HasPrefix(envValue, "@") {
+			iceServers, err = readIceServersSource(httpClient, strings.TrimPrefix(envValue, "@"))
+			break
+		}
+		if err = json.Unmarshal([]byte(envValue), &iceServers); err != nil {
+			err = fmt.Errorf("invalid %s: %v", IceServersEnvName, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := validateIceServers(iceServers); err != nil {
+		return nil, err
+	}
+	return iceServers, nil
+}
+
+// readIceServersSource reads JSON of ICE servers from HTTP(S) URL or file path
+func readIceServersSource(httpClient *http.Client, source string) ([]iceServerFlag, error) {
+	var jsonBytes []byte
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		res, err := httpClient.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			return nil, fmt.Errorf("failed to fetch ICE servers from %s: status=%d", source, res.StatusCode)
+		}
+		jsonBytes, err = io.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		jsonBytes, err = os.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var iceServers []iceServerFlag
+	if err := json.Unmarshal(jsonBytes, &iceServers); err != nil {
+		return nil, fmt.Errorf("invalid ICE servers in %s: %v", source, err)
+	}
+	return iceServers, nil
+}
+
+func validateIceServers(iceServers []iceServerFlag) error {
+	for _, s := range iceServers {
+		if len(s.URLs.values) == 0 && s.CredentialsUrl == "" {
+			return fmt.Errorf("urls of ICE server is required")
+		}
+		for _, u := range s.URLs.values {
+			parsed, err := ice.ParseURL(u)
+			if err != nil {
+				return fmt.Errorf("invalid ICE server URL '%s': %v", u, err)
+			}
+			isTurn := parsed.Scheme == ice.SchemeTypeTURN || parsed.Scheme == ice.SchemeTypeTURNS
+			if isTurn && s.Credential == "" && s.Secret == "" && s.CredentialsUrl == "" {
+				return fmt.Errorf("credential, secret or credentialsUrl is required for TURN server '%s'", u)
+			}
+		}
+	}
+	return nil
+}
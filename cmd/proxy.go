@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/pion/stun"
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyFromEnvironment is the value of --proxy to use environment variables such as HTTPS_PROXY and NO_PROXY
+const proxyFromEnvironment = "env"
+
+// createProxyFunc returns a proxy of --proxy
+// nil means direct connections, which keeps the behavior without --proxy even when HTTPS_PROXY is set.
+func createProxyFunc(proxyUrlStr string /* empty string OK */) (func(*http.Request) (*url.URL, error), error) {
+	switch proxyUrlStr {
+	case "":
+		return nil, nil
+	case proxyFromEnvironment:
+		return http.ProxyFromEnvironment, nil
+	}
+	proxyUrl, err := url.Parse(proxyUrlStr)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyUrl.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme '%s' (http, https, socks5 and socks5h are supported)", proxyUrl.Scheme)
+	}
+	return http.ProxyURL(proxyUrl), nil
+}
+
+// iceProxyDialer dials TURN servers over TCP or TLS through the same proxy as HTTP
+type iceProxyDialer struct {
+	proxyFunc func(*http.Request) (*url.URL, error)
+	// NOTE: pion does not tell whether TLS is needed, so "turns:" addresses are given
+	tlsServerNames map[string]string
+	// Addresses of TURN servers over TCP or TLS
+	tcpAddresses []string
+	// --insecure skips verification of TURN servers and HTTPS proxies
+	insecureSkipVerify bool
+}
+
+// proxyTimeout limits dialing and handshakes with the proxy and TURN servers
+const proxyTimeout = 10 * time.Second
+
+var _ proxy.Dialer = (*iceProxyDialer)(nil)
+
+func newIceProxyDialer(proxyFunc func(*http.Request) (*url.URL, error), iceServers []webrtc.ICEServer, insecureSkipVerify bool) *iceProxyDialer {
+	tlsServerNames := map[string]string{}
+	var tcpAddresses []string
+	for _, iceServer := range iceServers {
+		for _, rawUrl := range iceServer.URLs {
+			uri, err := stun.ParseURI(rawUrl)
+			if err != nil || uri.Proto != stun.ProtoTypeTCP || (uri.Scheme != stun.SchemeTypeTURN && uri.Scheme != stun.SchemeTypeTURNS) {
+				continue
+			}
+			addr := net.JoinHostPort(uri.Host, strconv.Itoa(uri.Port))
+			tcpAddresses = append(tcpAddresses, addr)
+			if uri.Scheme == stun.SchemeTypeTURNS {
+				tlsServerNames[addr] = uri.Host
+			}
+		}
+	}
+	return &iceProxyDialer{proxyFunc: proxyFunc, tlsServerNames: tlsServerNames, tcpAddresses: tcpAddresses, insecureSkipVerify: insecureSkipVerify}
+}
+
+// usesProxy returns whether any TURN server over TCP or TLS is reached through a proxy
+// pion dials and handshakes by itself without the proxy dialer.
+func (d *iceProxyDialer) usesProxy() (bool, error) {
+	for _, addr := range d.tcpAddresses {
+		proxyUrl, err := d.proxy(addr)
+		if err != nil {
+			return false, err
+		}
+		if proxyUrl != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// proxy returns the proxy for addr, nil means direct
+func (d *iceProxyDialer) proxy(addr string) (*url.URL, error) {
+	if d.proxyFunc == nil {
+		return nil, nil
+	}
+	return d.proxyFunc(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+}
+
+func (d *iceProxyDialer) Dial(network, addr string) (net.Conn, error) {
+	addr, err := normalizeIceAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.dialThroughProxy(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	serverName, ok := d.tlsServerNames[addr]
+	if !ok {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: d.insecureSkipVerify})
+	_ = conn.SetDeadline(time.Now().Add(proxyTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// normalizeIceAddress brackets IPv6 addresses because pion gives "host:port" without brackets such as "fd00::1:5349"
+func normalizeIceAddress(addr string) (string, error) {
+	if strings.HasPrefix(addr, "[") {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(host, port), nil
+	}
+	i := strings.LastIndex(addr, ":")
+	if i == -1 {
+		return "", fmt.Errorf("missing port in address %s", addr)
+	}
+	return net.JoinHostPort(addr[:i], addr[i+1:]), nil
+}
+
+func (d *iceProxyDialer) dialThroughProxy(network, addr string) (net.Conn, error) {
+	proxyUrl, err := d.proxy(addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyUrl == nil {
+		return net.DialTimeout(network, addr, proxyTimeout)
+	}
+	switch proxyUrl.Scheme {
+	case "socks5", "socks5h":
+		socksDialer, err := proxy.FromURL(proxyUrl, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		return socksDialer.Dial(network, addr)
+	case "http", "https":
+		return httpConnect(proxyUrl, addr, d.insecureSkipVerify)
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme '%s'", proxyUrl.Scheme)
+}
+
+// httpConnect opens a tunnel to addr by HTTP CONNECT method
+func httpConnect(proxyUrl *url.URL, addr string, insecureSkipVerify bool) (net.Conn, error) {
+	proxyAddr := proxyUrl.Host
+	if proxyUrl.Port() == "" {
+		if proxyUrl.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxyUrl.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyUrl.Hostname(), "80")
+		}
+	}
+	var conn net.Conn
+	var err error
+	if proxyUrl.Scheme == "https" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: proxyTimeout}, "tcp", proxyAddr, &tls.Config{ServerName: proxyUrl.Hostname(), InsecureSkipVerify: insecureSkipVerify})
+	} else {
+		conn, err = net.DialTimeout("tcp", proxyAddr, proxyTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: The deadline is cleared after the handshake not to time out the tunnel
+	_ = conn.SetDeadline(time.Now().Add(proxyTimeout))
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxyUrl.User != nil {
+		password, _ := proxyUrl.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(proxyUrl.User.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	bufReader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(bufReader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != 200 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s failed: %s", addr, res.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if bufReader.Buffered() != 0 {
+		return &bufferedConn{Conn: conn, reader: bufReader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is net.Conn reading bytes buffered while reading the CONNECT response first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
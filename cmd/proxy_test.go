@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"github.com/pion/webrtc/v3"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestNormalizeIceAddress(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		hasError bool
+	}{
+		{input: "turn.example.com:5349", expected: "turn.example.com:5349"},
+		{input: "192.0.2.1:3478", expected: "192.0.2.1:3478"},
+		// NOTE: pion formats addresses by "%s:%d"
+		{input: "fd00::1:5349", expected: "[fd00::1]:5349"},
+		{input: "[fd00::1]:5349", expected: "[fd00::1]:5349"},
+		{input: "turn.example.com", hasError: true},
+		{input: "[fd00::1", hasError: true},
+	}
+	for _, test := range tests {
+		actual, err := normalizeIceAddress(test.input)
+		if test.hasError {
+			if err == nil {
+				t.Errorf("normalizeIceAddress(%q) = %q, want error", test.input, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizeIceAddress(%q) error: %v", test.input, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("normalizeIceAddress(%q) = %q, want %q", test.input, actual, test.expected)
+		}
+	}
+}
+
+func TestIceProxyDialerTlsServerNames(t *testing.T) {
+	d := newIceProxyDialer(nil, nil, false)
+	if len(d.tlsServerNames) != 0 {
+		t.Fatalf("tlsServerNames should be empty")
+	}
+	d = newIceProxyDialer(nil, []webrtc.ICEServer{{URLs: []string{"turns:[fd00::1]:5349?transport=tcp", "turns:turn.example.com:5349?transport=tcp", "turn:turn.example.com:3478"}}}, false)
+	for _, addr := range []string{"fd00::1:5349", "turn.example.com:5349"} {
+		normalized, err := normalizeIceAddress(addr)
+		if err != nil {
+			t.Fatalf("normalizeIceAddress(%q) error: %v", addr, err)
+		}
+		if _, ok := d.tlsServerNames[normalized]; !ok {
+			t.Errorf("%s should use TLS", addr)
+		}
+	}
+	if _, ok := d.tlsServerNames["turn.example.com:3478"]; ok {
+		t.Errorf("turn: should not use TLS")
+	}
+}
+
+func TestIceProxyDialerUsesProxy(t *testing.T) {
+	proxyUrl, _ := url.Parse("http://proxy.example.com:8080")
+	iceServers := []webrtc.ICEServer{{URLs: []string{"stun:stun.example.com:3478", "turn:turn.example.com:3478", "turns:turn.example.com:5349"}}}
+	tests := []struct {
+		name       string
+		proxyFunc  func(*http.Request) (*url.URL, error)
+		iceServers []webrtc.ICEServer
+		expected   bool
+	}{
+		{name: "no proxy", proxyFunc: nil, iceServers: iceServers, expected: false},
+		{name: "proxy", proxyFunc: http.ProxyURL(proxyUrl), iceServers: iceServers, expected: true},
+		{name: "no TURN over TCP", proxyFunc: http.ProxyURL(proxyUrl), iceServers: []webrtc.ICEServer{{URLs: []string{"turn:turn.example.com:3478"}}}, expected: false},
+		{name: "proxy returning nil", proxyFunc: func(*http.Request) (*url.URL, error) { return nil, nil }, iceServers: iceServers, expected: false},
+	}
+	for _, test := range tests {
+		actual, err := newIceProxyDialer(test.proxyFunc, test.iceServers, false).usesProxy()
+		if err != nil {
+			t.Errorf("%s: usesProxy() error: %v", test.name, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("%s: usesProxy() = %v, want %v", test.name, actual, test.expected)
+		}
+	}
+}
@@ -8,23 +8,50 @@ import (
 	"github.com/nwtgck/go-webrtc-piping/version"
 	"github.com/pion/webrtc/v3"
 	"github.com/spf13/cobra"
+	"io"
+	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
 )
 
 const (
-	ServerUrlEnvName = "PIPING_SERVER"
+	ServerUrlEnvName  = "PIPING_SERVER"
+	IceServersEnvName = "WEBRTC_PIPING_ICE_SERVERS"
+	TurnUsersEnvName  = "WEBRTC_PIPING_TURN_USERS"
 )
 
 var flags struct {
 	pipingServerUrl        string
 	dnsServer              string
+	proxy                  string
 	insecure               bool
 	httpHeaderKeyValueStrs []string
 	iceServers             []iceServerFlag
+	iceServersSource       string
+	iceServersFile         string
+	iceUdpMux              string
+	nat1To1Ips             []string
+	nat1To1CandidateType   string
+	iceInterfaces          []string
+	iceExcludeInterfaces   []string
+	iceIpFilters           []string
+	ipv4Only               bool
+	ipv6Only               bool
+	mdnsMode               string
+	iceTcp                 string
+	iceTcpActive           bool
+	iceTransportPolicy     string
+	candidateTypes         []string
+	iceDisconnectedTimeout time.Duration
+	iceFailedTimeout       time.Duration
+	iceKeepaliveInterval   time.Duration
+	dtlsRetransmission     time.Duration
+	iceLite                bool
+	showsPath              bool
 	showsVersion           bool
 	verbose                bool
 }
@@ -34,6 +61,12 @@ type iceServerFlag struct {
 	Username   string            `json:"username,omitempty"`
 	Credential string            `json:"credential,omitempty"`
 	// NOTE: credentialType is deprecated
+	// Shared secret of TURN REST API (e.g. use-auth-secret of coturn)
+	Secret string `json:"secret,omitempty"`
+	// Lifetime of credentials generated from secret in seconds
+	Ttl uint64 `json:"ttl,omitempty"`
+	// URL returning credentials of TURN REST API
+	CredentialsUrl string `json:"credentialsUrl,omitempty"`
 }
 
 // iceServerFlagUrls is string or []string
@@ -76,10 +109,32 @@ func init() {
 	}
 	RootCmd.PersistentFlags().StringVarP(&flags.pipingServerUrl, "server", "s", defaultServer, "Piping Server URL")
 	RootCmd.PersistentFlags().StringVar(&flags.dnsServer, "dns-server", "", "DNS server (e.g. 1.1.1.1:53)")
+	RootCmd.PersistentFlags().StringVar(&flags.proxy, "proxy", "", "HTTP or SOCKS5 proxy for Piping Server and TURN over TCP/TLS (e.g. http://proxy:8080, socks5://proxy:1080, env for HTTPS_PROXY, HTTP_PROXY and NO_PROXY env)")
 	// --insecure, -k is inspired by curl
 	RootCmd.PersistentFlags().BoolVarP(&flags.insecure, "insecure", "k", false, "Allow insecure server connections when using SSL")
 	RootCmd.PersistentFlags().StringArrayVarP(&flags.httpHeaderKeyValueStrs, "header", "H", []string{}, "HTTP header")
-	RootCmd.PersistentFlags().VarP(&JSONFlag{Value: &flags.iceServers}, "ice-servers", "i", "ICE servers")
+	RootCmd.PersistentFlags().VarP(&iceServersFlag{servers: &flags.iceServers, source: &flags.iceServersSource}, "ice-servers", "i", "ICE servers in JSON, or @URL or @file to load it (env: "+IceServersEnvName+")")
+	RootCmd.PersistentFlags().StringVar(&flags.iceServersFile, "ice-servers-file", "", "JSON file of ICE servers")
+	RootCmd.PersistentFlags().StringVar(&flags.iceUdpMux, "ice-udp-mux", "", "Share one UDP port among all peer connections (e.g. :3478)")
+	RootCmd.PersistentFlags().StringArrayVar(&flags.nat1To1Ips, "nat-1to1-ip", []string{}, "External IP address of 1:1 NAT (e.g. 203.0.113.1 or 203.0.113.1/10.0.0.1)")
+	RootCmd.PersistentFlags().StringVar(&flags.nat1To1CandidateType, "nat-1to1-candidate-type", "host", "Candidate type for --nat-1to1-ip (host, srflx)")
+	RootCmd.PersistentFlags().StringSliceVar(&flags.iceInterfaces, "ice-interfaces", []string{}, "Network interfaces used for ICE candidates (e.g. eth0,wlan*)")
+	RootCmd.PersistentFlags().StringSliceVar(&flags.iceExcludeInterfaces, "ice-exclude-interfaces", []string{}, "Network interfaces not used for ICE candidates (e.g. docker*,tun0)")
+	RootCmd.PersistentFlags().StringSliceVar(&flags.iceIpFilters, "ice-ip-filter", []string{}, "CIDRs used for ICE candidates, prefix ! to exclude (e.g. 192.168.0.0/16,!172.17.0.0/16)")
+	RootCmd.PersistentFlags().BoolVar(&flags.ipv4Only, "ipv4-only", false, "Use only IPv4 for ICE candidates")
+	RootCmd.PersistentFlags().BoolVar(&flags.ipv6Only, "ipv6-only", false, "Use only IPv6 for ICE candidates")
+	RootCmd.PersistentFlags().StringVar(&flags.mdnsMode, "mdns", "query-only", "mDNS candidate mode (disabled, query-only, query-and-gather)")
+	RootCmd.PersistentFlags().StringVar(&flags.iceTcp, "ice-tcp", "", "Listen for ICE-TCP passive candidates (e.g. :3478)")
+	RootCmd.PersistentFlags().BoolVar(&flags.iceTcpActive, "ice-tcp-active", false, "Connect to ICE-TCP passive candidates of the peer")
+	RootCmd.PersistentFlags().StringVar(&flags.iceTransportPolicy, "ice-transport-policy", "all", "ICE transport policy (all, relay)")
+	RootCmd.PersistentFlags().StringSliceVar(&flags.candidateTypes, "candidate-types", []string{}, "Candidate types to send and receive (e.g. host,srflx,relay)")
+	// NOTE: default values are the same as pion's ones
+	RootCmd.PersistentFlags().DurationVar(&flags.iceDisconnectedTimeout, "ice-disconnected-timeout", 5*time.Second, "Duration without network activity before ICE is disconnected")
+	RootCmd.PersistentFlags().DurationVar(&flags.iceFailedTimeout, "ice-failed-timeout", 25*time.Second, "Duration without network activity after disconnected before ICE is failed")
+	RootCmd.PersistentFlags().DurationVar(&flags.iceKeepaliveInterval, "ice-keepalive-interval", 2*time.Second, "Interval of ICE keepalive")
+	RootCmd.PersistentFlags().DurationVar(&flags.dtlsRetransmission, "dtls-retransmission-interval", time.Second, "Interval of DTLS handshake retransmission")
+	RootCmd.PersistentFlags().BoolVar(&flags.iceLite, "ice-lite", false, "ICE-Lite mode with host candidates only for a peer with a public IP address")
+	RootCmd.PersistentFlags().BoolVar(&flags.showsPath, "show-path", false, "Print the selected ICE candidate pair and RTT to stderr")
 	RootCmd.PersistentFlags().BoolVarP(&flags.showsVersion, "version", "V", false, "show version")
 	RootCmd.PersistentFlags().BoolVarP(&flags.verbose, "verbose", "v", false, "verbose output")
 }
@@ -98,11 +153,12 @@ var RootCmd = &cobra.Command{
 	},
 }
 
-func createHttpClient(insecureSkipVerify bool, dnsServer string /* empty string OK */) *http.Client {
+func createHttpClient(insecureSkipVerify bool, dnsServer string /* empty string OK */, proxy func(*http.Request) (*url.URL, error)) *http.Client {
 	// Set insecure or not
 	tr := &http.Transport{
 		TLSClientConfig:   &tls.Config{InsecureSkipVerify: insecureSkipVerify},
 		ForceAttemptHTTP2: true,
+		Proxy:             proxy,
 	}
 	if dnsServer != "" {
 		tr.DialContext = createDialContext(dnsServer)
@@ -110,9 +166,12 @@ func createHttpClient(insecureSkipVerify bool, dnsServer string /* empty string
 	return &http.Client{Transport: tr}
 }
 
-// Set default resolver for HTTP client
-func createDialContext(dnsServer string) func(ctx context.Context, network, address string) (net.Conn, error) {
-	resolver := &net.Resolver{
+// createResolver returns the resolver using --dns-server or the default resolver
+func createResolver(dnsServer string /* empty string OK */) *net.Resolver {
+	if dnsServer == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
 			d := net.Dialer{
@@ -121,6 +180,11 @@ func createDialContext(dnsServer string) func(ctx context.Context, network, addr
 			return d.DialContext(ctx, "udp", dnsServer)
 		},
 	}
+}
+
+// Set default resolver for HTTP client
+func createDialContext(dnsServer string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	resolver := createResolver(dnsServer)
 
 	// Resolver for HTTP
 	return func(ctx context.Context, network, address string) (net.Conn, error) {
@@ -144,16 +208,66 @@ func parseHeaderKeyValueStrs(strKeyValues []string) ([][]string, error) {
 	return keyValues, nil
 }
 
-func createWebrtcConfig() webrtc.Configuration {
-	iceServer := make([]webrtc.ICEServer, len(flags.iceServers))
-	for i, d := range flags.iceServers {
-		iceServer[i] = webrtc.ICEServer{
-			URLs:       d.URLs.values,
-			Username:   d.Username,
-			Credential: d.Credential,
+func createWebrtcConfig(httpClient *http.Client) (webrtc.Configuration, error) {
+	webrtcConfigFunc, err := createWebrtcConfigFunc(httpClient)
+	if err != nil {
+		return webrtc.Configuration{}, err
+	}
+	return webrtcConfigFunc()
+}
+
+// createWebrtcConfigFunc returns a function creating a configuration for each session so that TURN REST API credentials are not expired
+func createWebrtcConfigFunc(httpClient *http.Client) (func() (webrtc.Configuration, error), error) {
+	iceServers, err := loadIceServers(httpClient)
+	if err != nil {
+		return nil, err
+	}
+	var iceTransportPolicy webrtc.ICETransportPolicy
+	switch flags.iceTransportPolicy {
+	case "all":
+		iceTransportPolicy = webrtc.ICETransportPolicyAll
+	case "relay":
+		iceTransportPolicy = webrtc.ICETransportPolicyRelay
+	default:
+		return nil, fmt.Errorf("--ice-transport-policy should be all or relay but %s", flags.iceTransportPolicy)
+	}
+	credentialsCache := newTurnCredentialsCache(httpClient)
+	return func() (webrtc.Configuration, error) {
+		iceServer := make([]webrtc.ICEServer, len(iceServers))
+		for i, d := range iceServers {
+			s, err := createIceServer(credentialsCache, d)
+			if err != nil {
+				return webrtc.Configuration{}, err
+			}
+			iceServer[i] = s
 		}
+		return webrtc.Configuration{
+			ICEServers:         iceServer,
+			ICETransportPolicy: iceTransportPolicy,
+		}, nil
+	}, nil
+}
+
+// parseCandidateTypes returns nil when no types are specified, which means all types
+func parseCandidateTypes(strs []string) ([]webrtc.ICECandidateType, error) {
+	var candidateTypes []webrtc.ICECandidateType
+	for _, str := range strs {
+		candidateType, err := webrtc.NewICECandidateType(str)
+		if err != nil {
+			return nil, err
+		}
+		candidateTypes = append(candidateTypes, candidateType)
+	}
+	return candidateTypes, nil
+}
+
+// createPathLogger creates a logger for the connection path, which is printed also without --verbose when --show-path is specified
+func createPathLogger(logger *log.Logger) *log.Logger {
+	if flags.verbose {
+		return logger
 	}
-	return webrtc.Configuration{
-		ICEServers: iceServer,
+	if flags.showsPath {
+		return log.New(os.Stderr, "", 0)
 	}
+	return log.New(io.Discard, "", 0)
 }
@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// createSettingEngine returns a SettingEngine shared by all peer connections of the process
+func createSettingEngine(proxyFunc func(*http.Request) (*url.URL, error), iceServers []webrtc.ICEServer) (webrtc.SettingEngine, error) {
+	s := webrtc.SettingEngine{}
+	iceProxyDialer := newIceProxyDialer(proxyFunc, iceServers, flags.insecure)
+	usesProxy, err := iceProxyDialer.usesProxy()
+	if err != nil {
+		return s, err
+	}
+	if usesProxy {
+		s.SetICEProxyDialer(iceProxyDialer)
+	}
+	if flags.iceLite {
+		if flags.iceTransportPolicy == "relay" {
+			return s, fmt.Errorf("--ice-lite cannot be used with --ice-transport-policy relay because ICE-Lite gathers host candidates only")
+		}
+		// NOTE: pion gathers host candidates only and becomes ICE controlled agent in lite mode
+		s.SetLite(true)
+	}
+	// NOTE: zero means disabled
+	if flags.iceDisconnectedTimeout != 0 && flags.iceKeepaliveInterval != 0 && flags.iceKeepaliveInterval >= flags.iceDisconnectedTimeout {
+		return s, fmt.Errorf("--ice-keepalive-interval should be shorter than --ice-disconnected-timeout")
+	}
+	s.SetICETimeouts(flags.iceDisconnectedTimeout, flags.iceFailedTimeout, flags.iceKeepaliveInterval)
+	s.SetDTLSRetransmissionInterval(flags.dtlsRetransmission)
+	if flags.iceUdpMux != "" {
+		laddr, err := net.ResolveUDPAddr("udp", flags.iceUdpMux)
+		if err != nil {
+			return s, err
+		}
+		udpConn, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			return s, err
+		}
+		s.SetICEUDPMux(webrtc.NewICEUDPMux(nil, udpConn))
+	}
+	if flags.iceTcp != "" {
+		tcpListener, err := net.Listen("tcp", flags.iceTcp)
+		if err != nil {
+			return s, err
+		}
+		s.SetICETCPMux(webrtc.NewICETCPMux(nil, tcpListener, 8))
+	}
+	if len(flags.nat1To1Ips) != 0 {
+		candidateType, err := webrtc.NewICECandidateType(flags.nat1To1CandidateType)
+		if err != nil {
+			return s, err
+		}
+		if candidateType != webrtc.ICECandidateTypeHost && candidateType != webrtc.ICECandidateTypeSrflx {
+			return s, fmt.Errorf("--nat-1to1-candidate-type should be host or srflx but %s", flags.nat1To1CandidateType)
+		}
+		s.SetNAT1To1IPs(flags.nat1To1Ips, candidateType)
+	}
+	if len(flags.iceInterfaces) != 0 || len(flags.iceExcludeInterfaces) != 0 {
+		interfaceFilter, err := createInterfaceFilter(flags.iceInterfaces, flags.iceExcludeInterfaces)
+		if err != nil {
+			return s, err
+		}
+		s.SetInterfaceFilter(interfaceFilter)
+	}
+	if len(flags.iceIpFilters) != 0 {
+		ipFilter, err := createIpFilter(flags.iceIpFilters)
+		if err != nil {
+			return s, err
+		}
+		s.SetIPFilter(ipFilter)
+	}
+	networkTypes, err := createNetworkTypes()
+	if err != nil {
+		return s, err
+	}
+	if len(networkTypes) != 0 {
+		s.SetNetworkTypes(networkTypes)
+	}
+	mdnsMode, err := parseMdnsMode(flags.mdnsMode)
+	if err != nil {
+		return s, err
+	}
+	s.SetICEMulticastDNSMode(mdnsMode)
+	return s, nil
+}
+
+func parseMdnsMode(s string) (ice.MulticastDNSMode, error) {
+	switch s {
+	case "disabled":
+		return ice.MulticastDNSModeDisabled, nil
+	case "query-only":
+		return ice.MulticastDNSModeQueryOnly, nil
+	case "query-and-gather":
+		return ice.MulticastDNSModeQueryAndGather, nil
+	}
+	return 0, fmt.Errorf("--mdns should be disabled, query-only or query-and-gather but %s", s)
+}
+
+// createInterfaceFilter returns a filter which accepts interfaces matching one of includes (all if empty) and none of excludes
+func createInterfaceFilter(includes []string, excludes []string) (func(string) bool, error) {
+	for _, pattern := range append(includes, excludes...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid interface pattern '%s': %v", pattern, err)
+		}
+	}
+	matchesAny := func(patterns []string, name string) bool {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+		return false
+	}
+	return func(name string) bool {
+		if matchesAny(excludes, name) {
+			return false
+		}
+		return len(includes) == 0 || matchesAny(includes, name)
+	}, nil
+}
+
+// createIpFilter returns a filter which accepts IPs in one of included CIDRs (all if none) and in none of "!"-prefixed CIDRs
+func createIpFilter(rules []string) (func(net.IP) bool, error) {
+	var includes []*net.IPNet
+	var excludes []*net.IPNet
+	for _, rule := range rules {
+		excluded := strings.HasPrefix(rule, "!")
+		_, ipNet, err := net.ParseCIDR(strings.TrimPrefix(rule, "!"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP filter '%s': %v", rule, err)
+		}
+		if excluded {
+			excludes = append(excludes, ipNet)
+		} else {
+			includes = append(includes, ipNet)
+		}
+	}
+	containsAny := func(ipNets []*net.IPNet, ip net.IP) bool {
+		for _, ipNet := range ipNets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(ip net.IP) bool {
+		if containsAny(excludes, ip) {
+			return false
+		}
+		return len(includes) == 0 || containsAny(includes, ip)
+	}, nil
+}
+
+// createNetworkTypes returns nil when pion's default network types should be used
+func createNetworkTypes() ([]webrtc.NetworkType, error) {
+	if flags.ipv4Only && flags.ipv6Only {
+		return nil, fmt.Errorf("--ipv4-only and --ipv6-only cannot be specified together")
+	}
+	usesTcp := flags.iceTcp != "" || flags.iceTcpActive
+	if !flags.ipv4Only && !flags.ipv6Only && !usesTcp {
+		return nil, nil
+	}
+	var networkTypes []webrtc.NetworkType
+	if !flags.ipv6Only {
+		networkTypes = append(networkTypes, webrtc.NetworkTypeUDP4)
+		if usesTcp {
+			networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4)
+		}
+	}
+	if !flags.ipv4Only {
+		networkTypes = append(networkTypes, webrtc.NetworkTypeUDP6)
+		if usesTcp {
+			networkTypes = append(networkTypes, webrtc.NetworkTypeTCP6)
+		}
+	}
+	return networkTypes, nil
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCreateInterfaceFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		includes []string
+		excludes []string
+		iface    string
+		expected bool
+	}{
+		{name: "no patterns", iface: "eth0", expected: true},
+		{name: "included", includes: []string{"eth*"}, iface: "eth0", expected: true},
+		{name: "not included", includes: []string{"eth*"}, iface: "wlan0", expected: false},
+		{name: "excluded", excludes: []string{"docker*", "tun0"}, iface: "docker0", expected: false},
+		{name: "not excluded", excludes: []string{"docker*", "tun0"}, iface: "eth0", expected: true},
+		{name: "exclude wins", includes: []string{"*"}, excludes: []string{"tun0"}, iface: "tun0", expected: false},
+	}
+	for _, test := range tests {
+		filter, err := createInterfaceFilter(test.includes, test.excludes)
+		if err != nil {
+			t.Errorf("%s: createInterfaceFilter() error: %v", test.name, err)
+			continue
+		}
+		if actual := filter(test.iface); actual != test.expected {
+			t.Errorf("%s: filter(%s) = %v, want %v", test.name, test.iface, actual, test.expected)
+		}
+	}
+	if _, err := createInterfaceFilter([]string{"eth["}, nil); err == nil {
+		t.Errorf("invalid pattern should fail")
+	}
+}
+
+func TestCreateIpFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []string
+		ip       string
+		expected bool
+	}{
+		{name: "included", rules: []string{"192.168.0.0/16"}, ip: "192.168.1.1", expected: true},
+		{name: "not included", rules: []string{"192.168.0.0/16"}, ip: "10.0.0.1", expected: false},
+		{name: "excluded", rules: []string{"!172.16.0.0/12"}, ip: "172.17.0.1", expected: false},
+		{name: "not excluded", rules: []string{"!172.16.0.0/12"}, ip: "10.0.0.1", expected: true},
+		{name: "exclude wins", rules: []string{"10.0.0.0/8", "!10.1.0.0/16"}, ip: "10.1.0.1", expected: false},
+		{name: "IPv6 included", rules: []string{"fd00::/8"}, ip: "fd00::1", expected: true},
+		{name: "IPv6 not included", rules: []string{"10.0.0.0/8"}, ip: "fd00::1", expected: false},
+	}
+	for _, test := range tests {
+		filter, err := createIpFilter(test.rules)
+		if err != nil {
+			t.Errorf("%s: createIpFilter() error: %v", test.name, err)
+			continue
+		}
+		if actual := filter(net.ParseIP(test.ip)); actual != test.expected {
+			t.Errorf("%s: filter(%s) = %v, want %v", test.name, test.ip, actual, test.expected)
+		}
+	}
+	for _, rule := range []string{"192.168.1.1", "!", "!10.0.0.0/33"} {
+		if _, err := createIpFilter([]string{rule}); err == nil {
+			t.Errorf("createIpFilter(%q) should fail", rule)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/spf13/cobra"
 	"io"
 	"log"
+	"net"
 	"os"
 	"strconv"
 )
@@ -19,26 +20,103 @@ var tunnelFlags struct {
 	verbose                bool
 	listens                bool
 	usesUdp                bool
+	forwardStrs            []string
+	reverseForwardStrs     []string
+	allowedTargets         []string
+	allowedListenAddresses []string
+	persistent             bool
+	hub                    bool
+	joinsHub               bool
+	gatewayPorts           bool
+	socks5Address          string
+	httpProxyAddress       string
+	unixSocketModeStr      string
 }
 
 func init() {
 	RootCmd.AddCommand(TunnelCmd)
 	TunnelCmd.Flags().BoolVarP(&tunnelFlags.listens, "listen", "l", false, "listen mode")
 	TunnelCmd.Flags().BoolVarP(&tunnelFlags.usesUdp, "udp", "u", false, "UDP")
+	TunnelCmd.Flags().StringArrayVarP(&tunnelFlags.forwardStrs, "local-forward", "L", []string{}, "Forward local port to remote target in listen mode (e.g. 15432:5432, 0.0.0.0:15432:db.internal:5432, unix:/tmp/docker.sock:unix:/var/run/docker.sock)")
+	TunnelCmd.Flags().StringVar(&tunnelFlags.socks5Address, "socks5", "", "Listen for SOCKS5 in listen mode (e.g. 1080, 0.0.0.0:1080)")
+	TunnelCmd.Flags().StringVar(&tunnelFlags.httpProxyAddress, "http-proxy", "", "Listen for HTTP proxy in listen mode (e.g. 8080, 0.0.0.0:8080)")
+	TunnelCmd.Flags().StringVar(&tunnelFlags.unixSocketModeStr, "unix-socket-mode", "", "File mode of listening Unix domain socket (e.g. 0600)")
+	TunnelCmd.Flags().BoolVarP(&tunnelFlags.gatewayPorts, "gateway-ports", "g", false, "Listen on all interfaces by default instead of loopback")
+	TunnelCmd.Flags().BoolVar(&tunnelFlags.persistent, "persistent", false, "Wait for a new peer after the peer has gone")
+	TunnelCmd.Flags().BoolVar(&tunnelFlags.hub, "hub", false, "Accept multiple peers joining by --join concurrently")
+	TunnelCmd.Flags().BoolVar(&tunnelFlags.joinsHub, "join", false, "Join the peer by --hub")
+	TunnelCmd.Flags().StringArrayVarP(&tunnelFlags.reverseForwardStrs, "remote-forward", "R", []string{}, "Forward remote port of the peer to local target in listen mode (e.g. 8080:80, 0.0.0.0:2222:22)")
+	TunnelCmd.Flags().StringArrayVar(&tunnelFlags.allowedListenAddresses, "allow-remote-forward", []string{}, "Allow listening on port requested by -R of listener (e.g. 8080, 80*, unix:/tmp/*)")
+	TunnelCmd.Flags().StringArrayVar(&tunnelFlags.allowedTargets, "allow", []string{}, "Allow target requested by listener (e.g. 5432, db.internal:*)")
 }
 
 var TunnelCmd = &cobra.Command{
 	Use:   "tunnel",
 	Short: "Tunneling TCP or UDP",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if len(args) != 2 {
-			return fmt.Errorf("port and path are required")
+		var portOrTarget string
+		var path string
+		switch {
+		case len(args) == 2:
+			portOrTarget = args[0]
+			path = args[1]
+		// NOTE: The dialer only with the path serves targets by --allow and reverse forwards requested by the listener
+		case len(args) == 1 && (!tunnelFlags.listens || len(tunnelFlags.forwardStrs) != 0 || len(tunnelFlags.reverseForwardStrs) != 0 || tunnelFlags.socks5Address != "" || tunnelFlags.httpProxyAddress != ""):
+			path = args[0]
+		default:
+			return fmt.Errorf("port (or host:port) and path are required")
 		}
-		portStr := args[0]
-		path := args[1]
-		port, err := strconv.Atoi(portStr)
-		if err != nil {
-			return err
+		// NOTE: The first argument is [bindAddress:]port in listen mode and the target, port or host:port, otherwise
+		defaultBindAddress := tunnel.DefaultBindAddress
+		if tunnelFlags.gatewayPorts {
+			defaultBindAddress = ""
+		}
+		var unixSocketMode os.FileMode
+		if tunnelFlags.unixSocketModeStr != "" {
+			mode, err := strconv.ParseUint(tunnelFlags.unixSocketModeStr, 8, 32)
+			if err != nil || mode > 0777 {
+				return fmt.Errorf("invalid --unix-socket-mode: %s", tunnelFlags.unixSocketModeStr)
+			}
+			unixSocketMode = os.FileMode(mode)
+		}
+		var forwards []tunnel.Forward
+		if portOrTarget != "" {
+			if tunnelFlags.listens {
+				forward, err := tunnel.ParseListenAddress(portOrTarget, defaultBindAddress)
+				if err != nil {
+					return err
+				}
+				forwards = append(forwards, forward)
+			} else if err := tunnel.ValidateTarget(portOrTarget); err != nil {
+				return err
+			}
+		}
+		if tunnelFlags.listens && len(tunnelFlags.allowedTargets) != 0 {
+			return fmt.Errorf("--allow is for dialer")
+		}
+		if tunnelFlags.listens && len(tunnelFlags.allowedListenAddresses) != 0 {
+			return fmt.Errorf("--allow-remote-forward is for dialer")
+		}
+		if !tunnelFlags.listens && len(tunnelFlags.forwardStrs) != 0 {
+			return fmt.Errorf("--local-forward is for listen mode")
+		}
+		if !tunnelFlags.listens && len(tunnelFlags.reverseForwardStrs) != 0 {
+			return fmt.Errorf("--remote-forward is for listen mode")
+		}
+		if !tunnelFlags.listens && tunnelFlags.socks5Address != "" {
+			return fmt.Errorf("--socks5 is for listen mode")
+		}
+		if !tunnelFlags.listens && tunnelFlags.httpProxyAddress != "" {
+			return fmt.Errorf("--http-proxy is for listen mode")
+		}
+		peerMode := tunnel.PeerModeSingle
+		if tunnelFlags.hub {
+			if tunnelFlags.joinsHub {
+				return fmt.Errorf("--hub and --join cannot be used together")
+			}
+			peerMode = tunnel.PeerModeHub
+		} else if tunnelFlags.joinsHub {
+			peerMode = tunnel.PeerModeJoin
 		}
 
 		var logger *log.Logger
@@ -48,22 +126,117 @@ var TunnelCmd = &cobra.Command{
 			logger = log.New(io.Discard, "", 0)
 		}
 
-		httpClient := createHttpClient(flags.insecure, flags.dnsServer)
+		pathLogger := createPathLogger(logger)
+
+		proxyFunc, err := createProxyFunc(flags.proxy)
+		if err != nil {
+			return err
+		}
+		httpClient := createHttpClient(flags.insecure, flags.dnsServer, proxyFunc)
 		httpHeaders, err := parseHeaderKeyValueStrs(flags.httpHeaderKeyValueStrs)
 		if err != nil {
 			return err
 		}
 
-		webrtcConfig := createWebrtcConfig()
+		webrtcConfigFunc, err := createWebrtcConfigFunc(httpClient)
+		if err != nil {
+			return err
+		}
+		// NOTE: The ICE servers are checked here and each session creates its own configuration
+		webrtcConfig, err := webrtcConfigFunc()
+		if err != nil {
+			return err
+		}
+		settingEngine, err := createSettingEngine(proxyFunc, webrtcConfig.ICEServers)
+		if err != nil {
+			return err
+		}
+		candidateTypes, err := parseCandidateTypes(flags.candidateTypes)
+		if err != nil {
+			return err
+		}
+		networkType := tunnel.NetworkTypeTcp
 		if tunnelFlags.usesUdp {
-			if tunnelFlags.listens {
-				return tunnel.Listener(logger, httpClient, flags.pipingServerUrl, httpHeaders, tunnel.NetworkTypeUdp, uint16(port), path, webrtcConfig)
-			}
-			return tunnel.Dialer(logger, httpClient, flags.pipingServerUrl, httpHeaders, tunnel.NetworkTypeUdp, uint16(port), path, webrtcConfig)
+			networkType = tunnel.NetworkTypeUdp
+		}
+		dialContext := (&net.Dialer{}).DialContext
+		if flags.dnsServer != "" {
+			dialContext = createDialContext(flags.dnsServer)
 		}
 		if tunnelFlags.listens {
-			return tunnel.Listener(logger, httpClient, flags.pipingServerUrl, httpHeaders, tunnel.NetworkTypeTcp, uint16(port), path, webrtcConfig)
+			var reverseForwards []tunnel.ReverseForward
+			for _, reverseForwardStr := range tunnelFlags.reverseForwardStrs {
+				reverseForward, err := tunnel.ParseReverseForward(reverseForwardStr)
+				if err != nil {
+					return err
+				}
+				reverseForwards = append(reverseForwards, reverseForward)
+			}
+			for _, forwardStr := range tunnelFlags.forwardStrs {
+				forward, err := tunnel.ParseForward(forwardStr, defaultBindAddress)
+				if err != nil {
+					return err
+				}
+				forwards = append(forwards, forward)
+			}
+			if tunnelFlags.socks5Address != "" {
+				forward, err := tunnel.ParseListenAddress(tunnelFlags.socks5Address, defaultBindAddress)
+				if err != nil {
+					return err
+				}
+				forward.Mode = tunnel.ForwardModeSocks5
+				forwards = append(forwards, forward)
+			}
+			if tunnelFlags.httpProxyAddress != "" {
+				forward, err := tunnel.ParseListenAddress(tunnelFlags.httpProxyAddress, defaultBindAddress)
+				if err != nil {
+					return err
+				}
+				forward.Mode = tunnel.ForwardModeHttpProxy
+				forwards = append(forwards, forward)
+			}
+			for i := range forwards {
+				forwards[i].UnixSocketMode = unixSocketMode
+			}
+			return tunnel.Listener(tunnel.ListenerOptions{
+				Logger:           logger,
+				PathLogger:       pathLogger,
+				Resolver:         createResolver(flags.dnsServer),
+				HttpClient:       httpClient,
+				PipingServerUrl:  flags.pipingServerUrl,
+				HttpHeaders:      httpHeaders,
+				NetworkType:      networkType,
+				Forwards:         forwards,
+				ReverseForwards:  reverseForwards,
+				Path:             path,
+				PeerMode:         peerMode,
+				Persistent:       tunnelFlags.persistent,
+				DialContext:      dialContext,
+				SettingEngine:    settingEngine,
+				WebrtcConfigFunc: webrtcConfigFunc,
+				CandidateTypes:   candidateTypes,
+			})
 		}
-		return tunnel.Dialer(logger, httpClient, flags.pipingServerUrl, httpHeaders, tunnel.NetworkTypeTcp, uint16(port), path, webrtcConfig)
+		return tunnel.Dialer(tunnel.DialerOptions{
+			Logger:                 logger,
+			PathLogger:             pathLogger,
+			Resolver:               createResolver(flags.dnsServer),
+			HttpClient:             httpClient,
+			PipingServerUrl:        flags.pipingServerUrl,
+			HttpHeaders:            httpHeaders,
+			NetworkType:            networkType,
+			DefaultTarget:          portOrTarget,
+			AllowedTargets:         tunnelFlags.allowedTargets,
+			AllowedListenAddresses: tunnelFlags.allowedListenAddresses,
+			GatewayPorts:           tunnelFlags.gatewayPorts,
+			UnixSocketMode:         unixSocketMode,
+			Path:                   path,
+			PeerMode:               peerMode,
+			Persistent:             tunnelFlags.persistent,
+			DialContext:            dialContext,
+			SettingEngine:          settingEngine,
+			WebrtcConfigFunc:       webrtcConfigFunc,
+			CandidateTypes:         candidateTypes,
+		})
 	},
 }
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/pion/webrtc/v3"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Same as the default of coturn
+const defaultTurnCredentialTtl = 24 * 60 * 60
+
+// (base: https://datatracker.ietf.org/doc/html/draft-uberti-behave-turn-rest-00#section-2.2)
+type turnRestResponse struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Uris     []string `json:"uris"`
+	Ttl      uint64   `json:"ttl"`
+}
+
+func createIceServer(credentialsCache *turnCredentialsCache, d iceServerFlag) (webrtc.ICEServer, error) {
+	if d.Secret != "" && d.CredentialsUrl != "" {
+		return webrtc.ICEServer{}, fmt.Errorf("secret and credentialsUrl cannot be specified together")
+	}
+	if (d.Secret != "" || d.CredentialsUrl != "") && d.Credential != "" {
+		return webrtc.ICEServer{}, fmt.Errorf("credential cannot be specified with secret or credentialsUrl")
+	}
+	if d.Secret != "" {
+		ttl := d.Ttl
+		if ttl == 0 {
+			ttl = defaultTurnCredentialTtl
+		}
+		username, credential := turnRestCredentials(d.Secret, d.Username, time.Now().Add(time.Duration(ttl)*time.Second))
+		return webrtc.ICEServer{
+			URLs:       d.URLs.values,
+			Username:   username,
+			Credential: credential,
+		}, nil
+	}
+	if d.CredentialsUrl != "" {
+		res, err := credentialsCache.fetch(d.CredentialsUrl)
+		if err != nil {
+			return webrtc.ICEServer{}, err
+		}
+		urls := d.URLs.values
+		if len(urls) == 0 {
+			urls = res.Uris
+		}
+		return webrtc.ICEServer{
+			URLs:       urls,
+			Username:   res.Username,
+			Credential: res.Password,
+		}, nil
+	}
+	return webrtc.ICEServer{
+		URLs:       d.URLs.values,
+		Username:   d.Username,
+		Credential: d.Credential,
+	}, nil
+}
+
+// turnRestCredentials generates time-limited credentials
+// username is "<expiry unix time>:<user>" and credential is base64(HMAC-SHA1(secret, username))
+func turnRestCredentials(secret string, user string, expiresAt time.Time) (username string, credential string) {
+	username = strconv.FormatInt(expiresAt.Unix(), 10)
+	if user != "" {
+		username += ":" + user
+	}
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// turnCredentialsCache keeps credentials fetched from credentialsUrl until the half of their TTL
+type turnCredentialsCache struct {
+	httpClient *http.Client
+	mux        sync.Mutex
+	entries    map[string]cachedTurnCredentials
+}
+
+type cachedTurnCredentials struct {
+	res       *turnRestResponse
+	expiresAt time.Time
+}
+
+func newTurnCredentialsCache(httpClient *http.Client) *turnCredentialsCache {
+	return &turnCredentialsCache{httpClient: httpClient, entries: map[string]cachedTurnCredentials{}}
+}
+
+// fetch returns the cached credentials or fetches new ones
+// NOTE: Credentials are refreshed at the half of TTL so that a new session has enough lifetime. No TTL means fetching for each session.
+func (c *turnCredentialsCache) fetch(url string) (*turnRestResponse, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if entry, ok := c.entries[url]; ok && time.Now().Before(entry.expiresAt) {
+		return entry.res, nil
+	}
+	res, err := fetchTurnCredentials(c.httpClient, url)
+	if err != nil {
+		return nil, err
+	}
+	c.entries[url] = cachedTurnCredentials{res: res, expiresAt: time.Now().Add(time.Duration(res.Ttl) * time.Second / 2)}
+	return res, nil
+}
+
+func fetchTurnCredentials(httpClient *http.Client, url string) (*turnRestResponse, error) {
+	res, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to fetch TURN credentials from %s: status=%d", url, res.StatusCode)
+	}
+	bodyBytes, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	var turnRes turnRestResponse
+	if err := json.Unmarshal(bodyBytes, &turnRes); err != nil {
+		return nil, fmt.Errorf("failed to parse TURN credentials from %s: %v", url, err)
+	}
+	return &turnRes, nil
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTurnRestCredentials(t *testing.T) {
+	tests := []struct {
+		secret             string
+		user               string
+		expiresAt          int64
+		expectedUsername   string
+		expectedCredential string
+	}{
+		// NOTE: The username is the example of draft-uberti-behave-turn-rest-00 and the credential is by `openssl dgst -sha1 -hmac mysecret -binary | base64`
+		{secret: "mysecret", user: "mbzrxpgjys", expiresAt: 12334939, expectedUsername: "12334939:mbzrxpgjys", expectedCredential: "2aJd/GqhrESBlOBrBOeXZdHVvYw="},
+		{secret: "mysecret", user: "", expiresAt: 1700000000, expectedUsername: "1700000000", expectedCredential: "p2S65t0MMfpLAZsHB0QVGbThXjA="},
+	}
+	for _, test := range tests {
+		username, credential := turnRestCredentials(test.secret, test.user, time.Unix(test.expiresAt, 0))
+		if username != test.expectedUsername || credential != test.expectedCredential {
+			t.Errorf("turnRestCredentials(%q, %q, %d) = %q, %q, want %q, %q", test.secret, test.user, test.expiresAt, username, credential, test.expectedUsername, test.expectedCredential)
+		}
+	}
+}
+
+func TestTurnCredentialsCacheRefreshesAtHalfTtl(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&requests, 1)
+		_, _ = fmt.Fprintf(w, `{"username": "user%d", "password": "pass", "uris": ["turn:turn.example.com:3478"], "ttl": 1}`, n)
+	}))
+	defer server.Close()
+	cache := newTurnCredentialsCache(server.Client())
+
+	first, err := cache.fetch(server.URL)
+	if err != nil {
+		t.Fatalf("fetch() error: %v", err)
+	}
+	second, err := cache.fetch(server.URL)
+	if err != nil {
+		t.Fatalf("fetch() error: %v", err)
+	}
+	if second.Username != first.Username || atomic.LoadInt64(&requests) != 1 {
+		t.Errorf("credentials should be cached before the half of TTL: %s, %s, requests=%d", first.Username, second.Username, atomic.LoadInt64(&requests))
+	}
+	// NOTE: Past the half of TTL 1s
+	time.Sleep(600 * time.Millisecond)
+	third, err := cache.fetch(server.URL)
+	if err != nil {
+		t.Fatalf("fetch() error: %v", err)
+	}
+	if third.Username == first.Username || atomic.LoadInt64(&requests) != 2 {
+		t.Errorf("credentials should be refreshed after the half of TTL: %s, %s, requests=%d", first.Username, third.Username, atomic.LoadInt64(&requests))
+	}
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"fmt"
+	turn_server "github.com/nwtgck/go-webrtc-piping/turn-server"
+	"github.com/spf13/cobra"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var turnServerFlags struct {
+	listen            string
+	realm             string
+	users             []string
+	usersFile         string
+	authSecret        string
+	publicIp          string
+	relayPortRange    string
+	allowPrivatePeers bool
+}
+
+func init() {
+	RootCmd.AddCommand(TurnServerCmd)
+	TurnServerCmd.Flags().StringVar(&turnServerFlags.listen, "listen", ":3478", "listen address for UDP and TCP")
+	TurnServerCmd.Flags().StringVar(&turnServerFlags.realm, "realm", "webrtc-piping", "realm")
+	TurnServerCmd.Flags().StringSliceVar(&turnServerFlags.users, "users", []string{}, fmt.Sprintf("users (e.g. user1=pass1,user2=pass2), which are visible in process list. --users-file or %s is recommended", TurnUsersEnvName))
+	TurnServerCmd.Flags().StringVar(&turnServerFlags.usersFile, "users-file", "", "file of users with one user=pass per line")
+	TurnServerCmd.Flags().StringVar(&turnServerFlags.authSecret, "auth-secret", "", "shared secret for TURN REST API credentials")
+	TurnServerCmd.Flags().StringVar(&turnServerFlags.publicIp, "public-ip", "", "IP address of relay candidates (default: source IP address of the default route, which is private behind NAT)")
+	TurnServerCmd.Flags().StringVar(&turnServerFlags.relayPortRange, "relay-port-range", "", "port range of relays (e.g. 49152-65535)")
+	TurnServerCmd.Flags().BoolVar(&turnServerFlags.allowPrivatePeers, "allow-private-peers", false, "allow relaying to loopback, private and link-local addresses")
+}
+
+var TurnServerCmd = &cobra.Command{
+	Use:   "turn-server",
+	Short: "TURN relay server",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var logger *log.Logger
+		if flags.verbose {
+			logger = log.New(os.Stderr, "", log.LstdFlags)
+		} else {
+			logger = log.New(io.Discard, "", 0)
+		}
+		users, err := loadTurnUsers()
+		if err != nil {
+			return err
+		}
+		if len(users) == 0 && turnServerFlags.authSecret == "" {
+			return fmt.Errorf("--users or --auth-secret is required")
+		}
+		var relayIp net.IP
+		if turnServerFlags.publicIp == "" {
+			relayIp, err = turn_server.DetectDefaultRouteIp()
+			if err != nil {
+				return err
+			}
+			if relayIp.IsPrivate() {
+				_, _ = fmt.Fprintf(os.Stderr, "relay IP %s is private. Specify --public-ip for peers behind other NATs\n", relayIp)
+			}
+		} else {
+			relayIp = net.ParseIP(turnServerFlags.publicIp)
+			if relayIp == nil {
+				return fmt.Errorf("invalid public IP '%s'", turnServerFlags.publicIp)
+			}
+		}
+		var minRelayPort, maxRelayPort uint16
+		if turnServerFlags.relayPortRange != "" {
+			var err error
+			minRelayPort, maxRelayPort, err = parsePortRange(turnServerFlags.relayPortRange)
+			if err != nil {
+				return err
+			}
+		}
+		_, _ = fmt.Fprintf(os.Stderr, "TURN server listening on %s (relay IP: %s)\n", turnServerFlags.listen, relayIp)
+		return turn_server.Serve(logger, turnServerFlags.listen, turnServerFlags.realm, relayIp, users, turnServerFlags.authSecret, minRelayPort, maxRelayPort, turnServerFlags.allowPrivatePeers)
+	},
+}
+
+// loadTurnUsers merges users of --users, --users-file and the environment variable
+func loadTurnUsers() (map[string]string, error) {
+	strs := append([]string{}, turnServerFlags.users...)
+	if envValue, ok := os.LookupEnv(TurnUsersEnvName); ok && envValue != "" {
+		strs = append(strs, strings.Split(envValue, ",")...)
+	}
+	if turnServerFlags.usersFile != "" {
+		content, err := os.ReadFile(turnServerFlags.usersFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			strs = append(strs, line)
+		}
+	}
+	users := map[string]string{}
+	for _, str := range strs {
+		splitted := strings.SplitN(str, "=", 2)
+		if len(splitted) != 2 {
+			// NOTE: The password is not printed
+			return nil, fmt.Errorf("invalid user format of '%s'", splitted[0])
+		}
+		users[splitted[0]] = splitted[1]
+	}
+	return users, nil
+}
+
+func parsePortRange(str string) (uint16, uint16, error) {
+	splitted := strings.SplitN(str, "-", 2)
+	if len(splitted) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range '%s'", str)
+	}
+	minPort, err := strconv.ParseUint(splitted[0], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range '%s': %v", str, err)
+	}
+	maxPort, err := strconv.ParseUint(splitted[1], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range '%s': %v", str, err)
+	}
+	if minPort == 0 || minPort > maxPort {
+		return 0, 0, fmt.Errorf("invalid port range '%s'", str)
+	}
+	return uint16(minPort), uint16(maxPort), nil
+}
@@ -0,0 +1,171 @@
+package connection_path
+
+import (
+	"context"
+	"fmt"
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reporter reports the selected ICE candidate pair and its RTT
+// It reports when the PeerConnection gets connected and whenever the selected pair changes after that.
+type Reporter struct {
+	logger         *log.Logger
+	peerConnection *webrtc.PeerConnection
+	turnServers    []turnServer
+	// Closed after IP addresses of turnServers are resolved
+	turnResolvedCh chan struct{}
+	mux            sync.Mutex
+	connected      bool
+	selectedPair   *webrtc.ICECandidatePair
+}
+
+type turnServer struct {
+	url  string
+	host string
+	ips  []net.IP
+}
+
+const turnLookupTimeout = 5 * time.Second
+
+// NewReporter should be called before signaling not to miss the selected pair change
+// TURN servers are resolved by the resolver in background not to block callbacks of pion.
+func NewReporter(logger *log.Logger, peerConnection *webrtc.PeerConnection, iceServers []webrtc.ICEServer, resolver *net.Resolver) *Reporter {
+	r := &Reporter{
+		logger:         logger,
+		peerConnection: peerConnection,
+		turnResolvedCh: make(chan struct{}),
+	}
+	for _, iceServer := range iceServers {
+		for _, urlStr := range iceServer.URLs {
+			url, err := ice.ParseURL(urlStr)
+			if err != nil || (url.Scheme != ice.SchemeTypeTURN && url.Scheme != ice.SchemeTypeTURNS) {
+				continue
+			}
+			r.turnServers = append(r.turnServers, turnServer{url: urlStr, host: url.Host})
+		}
+	}
+	// NOTE: No lookup is needed when nothing is printed
+	if logger.Writer() == io.Discard {
+		close(r.turnResolvedCh)
+	} else {
+		go r.resolveTurnServers(resolver)
+	}
+	peerConnection.SCTP().Transport().ICETransport().OnSelectedCandidatePairChange(func(pair *webrtc.ICECandidatePair) {
+		r.mux.Lock()
+		r.selectedPair = pair
+		connected := r.connected
+		r.mux.Unlock()
+		if connected {
+			r.report(pair)
+		}
+	})
+	return r
+}
+
+// OnConnectionStateChange should be called in the handler of PeerConnection.OnConnectionStateChange
+func (r *Reporter) OnConnectionStateChange(state webrtc.PeerConnectionState) {
+	if state != webrtc.PeerConnectionStateConnected {
+		return
+	}
+	r.mux.Lock()
+	r.connected = true
+	pair := r.selectedPair
+	r.mux.Unlock()
+	if pair == nil {
+		var err error
+		pair, err = r.peerConnection.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+		if err != nil || pair == nil {
+			r.logger.Printf("selected candidate pair not found")
+			return
+		}
+	}
+	r.report(pair)
+}
+
+func (r *Reporter) report(pair *webrtc.ICECandidatePair) {
+	stats := r.peerConnection.GetStats()
+	local := r.describeCandidate(stats, pair.Local, true)
+	remote := r.describeCandidate(stats, pair.Remote, false)
+	path := "direct"
+	if pair.Local.Typ == webrtc.ICECandidateTypeRelay || pair.Remote.Typ == webrtc.ICECandidateTypeRelay {
+		path = "relayed"
+	}
+	rtt := "unknown"
+	if pairStats, ok := r.peerConnection.SCTP().Transport().ICETransport().GetSelectedCandidatePairStats(); ok && pairStats.CurrentRoundTripTime > 0 {
+		rtt = (time.Duration(pairStats.CurrentRoundTripTime * float64(time.Second))).Round(time.Microsecond).String()
+	}
+	r.logger.Printf("connection path: %s, local: %s, remote: %s, RTT: %s", path, local, remote, rtt)
+}
+
+func (r *Reporter) describeCandidate(stats webrtc.StatsReport, candidate *webrtc.ICECandidate, isLocal bool) string {
+	s := fmt.Sprintf("%s %s %s", candidate.Typ, candidate.Protocol, net.JoinHostPort(candidate.Address, fmt.Sprint(candidate.Port)))
+	if candidate.Typ != webrtc.ICECandidateTypeRelay || !isLocal {
+		return s
+	}
+	var details []string
+	for _, stat := range stats {
+		candidateStats, ok := stat.(webrtc.ICECandidateStats)
+		if !ok || candidateStats.Type != webrtc.StatsTypeLocalCandidate || candidateStats.IP != candidate.Address || candidateStats.Port != int32(candidate.Port) {
+			continue
+		}
+		if candidateStats.RelayProtocol != "" {
+			details = append(details, "TURN over "+candidateStats.RelayProtocol)
+		}
+		break
+	}
+	if url := r.findTurnServer(candidate.Address); url != "" {
+		details = append(details, url)
+	}
+	if len(details) == 0 {
+		return s
+	}
+	return fmt.Sprintf("%s (%s)", s, strings.Join(details, ", "))
+}
+
+func (r *Reporter) resolveTurnServers(resolver *net.Resolver) {
+	defer close(r.turnResolvedCh)
+	ctx, cancel := context.WithTimeout(context.Background(), turnLookupTimeout)
+	defer cancel()
+	for i := range r.turnServers {
+		addrs, err := resolver.LookupIPAddr(ctx, r.turnServers[i].host)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			r.turnServers[i].ips = append(r.turnServers[i].ips, addr.IP)
+		}
+	}
+}
+
+// findTurnServer finds the TURN server which has the relayed address
+// It is a best-effort because the relayed address may differ from the addresses of the TURN server.
+// Addresses not resolved yet are not used not to block.
+func (r *Reporter) findTurnServer(relayedAddress string) string {
+	relayedIp := net.ParseIP(relayedAddress)
+	if relayedIp == nil {
+		return ""
+	}
+	select {
+	case <-r.turnResolvedCh:
+		for _, server := range r.turnServers {
+			for _, ip := range server.ips {
+				if ip.Equal(relayedIp) {
+					return server.url
+				}
+			}
+		}
+	default:
+	}
+	// The relay must be one of them if only one TURN server is configured
+	if len(r.turnServers) == 1 {
+		return r.turnServers[0].url
+	}
+	return ""
+}
@@ -0,0 +1,109 @@
+package doctor
+
+import (
+	"fmt"
+	"github.com/pion/stun"
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/net/proxy"
+	"io"
+	"net/http"
+	"time"
+)
+
+type report struct {
+	w       io.Writer
+	advices []string
+}
+
+func (r *report) ok(format string, a ...interface{}) {
+	_, _ = fmt.Fprintf(r.w, "[OK]   "+format+"\n", a...)
+}
+
+func (r *report) warn(format string, a ...interface{}) {
+	_, _ = fmt.Fprintf(r.w, "[WARN] "+format+"\n", a...)
+}
+
+func (r *report) ng(format string, a ...interface{}) {
+	_, _ = fmt.Fprintf(r.w, "[NG]   "+format+"\n", a...)
+}
+
+func (r *report) info(format string, a ...interface{}) {
+	_, _ = fmt.Fprintf(r.w, "       "+format+"\n", a...)
+}
+
+func (r *report) advise(format string, a ...interface{}) {
+	r.advices = append(r.advices, fmt.Sprintf(format, a...))
+}
+
+// Run checks the Piping Server, STUN servers and TURN servers and writes a report to w
+// It returns an error when any problem is found
+// tcpDialer is used for TURN over TCP
+func Run(w io.Writer, httpClient *http.Client, pipingServerUrl string, httpHeaders [][]string, iceServers []webrtc.ICEServer, tcpDialer proxy.Dialer) error {
+	r := &report{w: w}
+
+	_, _ = fmt.Fprintln(w, "== Piping Server")
+	checkPipingServer(r, httpClient, pipingServerUrl, httpHeaders)
+
+	var stunUris []*stun.URI
+	var turnServers []turnServer
+	for _, iceServer := range iceServers {
+		for _, rawUrl := range iceServer.URLs {
+			uri, err := stun.ParseURI(rawUrl)
+			if err != nil {
+				r.ng("invalid ICE server URL %s: %v", rawUrl, err)
+				continue
+			}
+			switch uri.Scheme {
+			case stun.SchemeTypeSTUN, stun.SchemeTypeSTUNS:
+				stunUris = append(stunUris, uri)
+			case stun.SchemeTypeTURN, stun.SchemeTypeTURNS:
+				credential, _ := iceServer.Credential.(string)
+				turnServers = append(turnServers, turnServer{rawUrl: rawUrl, uri: uri, username: iceServer.Username, credential: credential})
+			}
+		}
+	}
+
+	_, _ = fmt.Fprintln(w, "== STUN")
+	checkStun(r, stunUris)
+
+	_, _ = fmt.Fprintln(w, "== TURN")
+	checkTurn(r, turnServers, len(stunUris) != 0, tcpDialer)
+
+	_, _ = fmt.Fprintln(w, "== Advice")
+	if len(r.advices) == 0 {
+		_, _ = fmt.Fprintln(w, "No problems found.")
+		return nil
+	}
+	for _, advice := range r.advices {
+		_, _ = fmt.Fprintf(w, "* %s\n", advice)
+	}
+	return fmt.Errorf("%d problem(s) found", len(r.advices))
+}
+
+func checkPipingServer(r *report, httpClient *http.Client, pipingServerUrl string, httpHeaders [][]string) {
+	req, err := http.NewRequest("GET", pipingServerUrl, nil)
+	if err != nil {
+		r.ng("invalid Piping Server URL %s: %v", pipingServerUrl, err)
+		r.advise("Fix --server.")
+		return
+	}
+	for _, kv := range httpHeaders {
+		req.Header.Add(kv[0], kv[1])
+	}
+	start := time.Now()
+	res, err := httpClient.Do(req)
+	if err != nil {
+		r.ng("%s is not reachable: %v", pipingServerUrl, err)
+		r.advise("Check --server, --dns-server and --insecure, and whether a firewall or proxy blocks HTTP(S).")
+		return
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+	_ = res.Body.Close()
+	elapsed := time.Since(start)
+	if res.StatusCode >= 400 {
+		r.ng("%s responded %s", pipingServerUrl, res.Status)
+		r.advise("The Piping Server rejected the request. Check --header if the server requires authentication.")
+		return
+	}
+	r.ok("%s is reachable (%s, %s)", pipingServerUrl, res.Status, elapsed.Round(time.Millisecond))
+}
@@ -0,0 +1,199 @@
+package doctor
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pion/stun"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	stunTimeout = time.Second
+	stunRetries = 3
+)
+
+var errStunTimeout = errors.New("timeout")
+
+// CHANGE-REQUEST flags (base: https://datatracker.ietf.org/doc/html/rfc5780#section-7.2)
+const (
+	changeRequestIp   = 0x04
+	changeRequestPort = 0x02
+)
+
+type stunResponse struct {
+	mappedAddress *net.UDPAddr
+	otherAddress  *net.UDPAddr
+}
+
+// stunBinding sends a Binding request from conn and waits for the response
+// changeRequest is used for NAT filtering behavior discovery
+func stunBinding(conn *net.UDPConn, serverAddr *net.UDPAddr, changeRequest byte) (*stunResponse, error) {
+	setters := []stun.Setter{stun.TransactionID, stun.BindingRequest}
+	if changeRequest != 0 {
+		setters = append(setters, stun.RawAttribute{Type: stun.AttrChangeRequest, Value: []byte{0, 0, 0, changeRequest}})
+	}
+	setters = append(setters, stun.Fingerprint)
+	req, err := stun.Build(setters...)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	for i := 0; i < stunRetries; i++ {
+		if _, err := conn.WriteToUDP(req.Raw, serverAddr); err != nil {
+			return nil, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(stunTimeout)); err != nil {
+			return nil, err
+		}
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			res := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+			if err := res.Decode(); err != nil || res.TransactionID != req.TransactionID {
+				// Ignore unrelated packets such as late responses of previous requests
+				continue
+			}
+			if res.Type.Class == stun.ClassErrorResponse {
+				var errorCode stun.ErrorCodeAttribute
+				_ = errorCode.GetFrom(res)
+				return nil, fmt.Errorf("error response: %s", errorCode)
+			}
+			var xorAddr stun.XORMappedAddress
+			if err := xorAddr.GetFrom(res); err != nil {
+				return nil, err
+			}
+			stunRes := &stunResponse{mappedAddress: &net.UDPAddr{IP: xorAddr.IP, Port: xorAddr.Port}}
+			var otherAddr stun.OtherAddress
+			if err := otherAddr.GetFrom(res); err == nil {
+				stunRes.otherAddress = &net.UDPAddr{IP: otherAddr.IP, Port: otherAddr.Port}
+			}
+			return stunRes, nil
+		}
+	}
+	return nil, errStunTimeout
+}
+
+func checkStun(r *report, uris []*stun.URI) {
+	if len(uris) == 0 {
+		r.warn("no STUN servers are configured")
+		r.info("Only host candidates are available. Peers in different networks need STUN servers in --ice-servers")
+		return
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		r.ng("failed to open a UDP socket: %v", err)
+		return
+	}
+	defer conn.Close()
+	localPort := conn.LocalAddr().(*net.UDPAddr).Port
+
+	type result struct {
+		serverAddr *net.UDPAddr
+		res        *stunResponse
+	}
+	var results []result
+	for _, uri := range uris {
+		if uri.Scheme == stun.SchemeTypeSTUNS {
+			r.warn("%s: stuns is not checked", uri)
+			continue
+		}
+		serverAddr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(uri.Host, strconv.Itoa(uri.Port)))
+		if err != nil {
+			r.ng("%s: failed to resolve: %v", uri, err)
+			r.advise("Check DNS resolution of %s.", uri.Host)
+			continue
+		}
+		start := time.Now()
+		res, err := stunBinding(conn, serverAddr, 0)
+		if err != nil {
+			r.ng("%s: no response: %v", uri, err)
+			r.advise("%s is not reachable over UDP. UDP may be blocked by a firewall, use a TURN server over TCP or TLS (turn:...?transport=tcp or turns:).", uri)
+			continue
+		}
+		r.ok("%s: mapped address %s (%s)", uri, res.mappedAddress, time.Since(start).Round(time.Millisecond))
+		results = append(results, result{serverAddr: serverAddr, res: res})
+	}
+	if len(results) == 0 {
+		return
+	}
+
+	first := results[0]
+	if isLocalIp(first.res.mappedAddress.IP) && first.res.mappedAddress.Port == localPort {
+		r.ok("NAT: not behind NAT (public IP address %s)", first.res.mappedAddress.IP)
+		return
+	}
+
+	// Mapping behavior (base: https://datatracker.ietf.org/doc/html/rfc5780#section-4.3)
+	var mappedAddresses []*net.UDPAddr
+	for _, res := range results {
+		mappedAddresses = append(mappedAddresses, res.res.mappedAddress)
+	}
+	if first.res.otherAddress != nil {
+		// Same port, different IP address of the first server
+		altAddr := &net.UDPAddr{IP: first.res.otherAddress.IP, Port: first.serverAddr.Port}
+		if res, err := stunBinding(conn, altAddr, 0); err == nil {
+			mappedAddresses = append(mappedAddresses, res.mappedAddress)
+		}
+	}
+	if len(mappedAddresses) < 2 {
+		r.warn("NAT mapping behavior: unknown (configure two or more STUN servers or a server supporting RFC 5780)")
+	} else if allSameAddress(mappedAddresses) {
+		r.ok("NAT mapping behavior: endpoint-independent")
+	} else {
+		r.ng("NAT mapping behavior: endpoint-dependent (symmetric NAT)")
+		r.advise("Your NAT assigns a different public port to each destination, so direct connections usually fail. Configure a TURN server in --ice-servers (\"webrtc-piping turn-server\" can be used).")
+	}
+
+	// Filtering behavior (base: https://datatracker.ietf.org/doc/html/rfc5780#section-4.4)
+	if first.res.otherAddress == nil {
+		r.warn("NAT filtering behavior: unknown (%s does not support RFC 5780)", first.serverAddr)
+		return
+	}
+	// NOTE: A fresh binding is needed because conn has sent to the alternate address in the mapping test, which opens the NAT for it
+	filteringConn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		r.ng("failed to open a UDP socket: %v", err)
+		return
+	}
+	defer filteringConn.Close()
+	if _, err := stunBinding(filteringConn, first.serverAddr, changeRequestIp|changeRequestPort); err == nil {
+		r.ok("NAT filtering behavior: endpoint-independent")
+		return
+	}
+	if _, err := stunBinding(filteringConn, first.serverAddr, changeRequestPort); err == nil {
+		r.ok("NAT filtering behavior: address-dependent")
+		return
+	}
+	r.warn("NAT filtering behavior: address and port-dependent")
+	r.advise("Your NAT only accepts packets from addresses and ports you have sent to. Direct connections need the peer's NAT to be endpoint-independent mapping. Configure a TURN server if connections fail.")
+}
+
+func isLocalIp(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func allSameAddress(addrs []*net.UDPAddr) bool {
+	for _, addr := range addrs[1:] {
+		if !addr.IP.Equal(addrs[0].IP) || addr.Port != addrs[0].Port {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package doctor
+
+import (
+	"crypto/tls"
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+	"golang.org/x/net/proxy"
+	"net"
+	"strconv"
+	"time"
+)
+
+type turnServer struct {
+	rawUrl     string
+	uri        *stun.URI
+	username   string
+	credential string
+}
+
+func checkTurn(r *report, turnServers []turnServer, hasStun bool, tcpDialer proxy.Dialer) {
+	if len(turnServers) == 0 {
+		r.warn("no TURN servers are configured")
+		if !hasStun {
+			return
+		}
+		r.info("TURN servers are required when both peers are behind symmetric NAT or UDP is blocked")
+		return
+	}
+	for _, s := range turnServers {
+		start := time.Now()
+		relayedAddr, err := turnAllocate(s, tcpDialer)
+		if err != nil {
+			r.ng("%s: failed to allocate: %v", s.rawUrl, err)
+			r.advise("Allocation on %s failed. Check username and credential (or secret) in --ice-servers and whether the server is reachable.", s.rawUrl)
+			continue
+		}
+		r.ok("%s: relayed address %s (%s)", s.rawUrl, relayedAddr, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// turnAllocate validates credentials by an allocation and returns the relayed address
+func turnAllocate(s turnServer, tcpDialer proxy.Dialer) (net.Addr, error) {
+	serverAddr := net.JoinHostPort(s.uri.Host, strconv.Itoa(s.uri.Port))
+	var conn net.PacketConn
+	switch {
+	case s.uri.Scheme == stun.SchemeTypeTURNS:
+		tcpConn, err := tcpDialer.Dial("tcp", serverAddr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(tcpConn, &tls.Config{ServerName: s.uri.Host})
+		if err := tlsConn.Handshake(); err != nil {
+			tcpConn.Close()
+			return nil, err
+		}
+		conn = turn.NewSTUNConn(tlsConn)
+	case s.uri.Proto == stun.ProtoTypeTCP:
+		tcpConn, err := tcpDialer.Dial("tcp", serverAddr)
+		if err != nil {
+			return nil, err
+		}
+		conn = turn.NewSTUNConn(tcpConn)
+	default:
+		udpConn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+		if err != nil {
+			return nil, err
+		}
+		conn = udpConn
+	}
+	defer conn.Close()
+
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: serverAddr,
+		TURNServerAddr: serverAddr,
+		Conn:           conn,
+		Username:       s.username,
+		Password:       s.credential,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	if err := client.Listen(); err != nil {
+		return nil, err
+	}
+	relayConn, err := client.Allocate()
+	if err != nil {
+		return nil, err
+	}
+	defer relayConn.Close()
+	return relayConn.LocalAddr(), nil
+}
@@ -8,7 +8,7 @@ import (
 	"os"
 )
 
-func NewDetachablePeerConnection(configuration webrtc.Configuration) (*webrtc.PeerConnection, error) {
+func NewPeerConnection(settingEngine webrtc.SettingEngine, configuration webrtc.Configuration) (*webrtc.PeerConnection, error) {
 	m := &webrtc.MediaEngine{}
 	if err := m.RegisterDefaultCodecs(); err != nil {
 		return nil, err
@@ -19,13 +19,14 @@ func NewDetachablePeerConnection(configuration webrtc.Configuration) (*webrtc.Pe
 		return nil, err
 	}
 
-	s := webrtc.SettingEngine{}
-	s.DetachDataChannels()
-
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s))
-	//api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(settingEngine))
 	return api.NewPeerConnection(configuration)
-	//return webrtc.NewPeerConnection(configuration)
+}
+
+func NewDetachablePeerConnection(settingEngine webrtc.SettingEngine, configuration webrtc.Configuration) (*webrtc.PeerConnection, error) {
+	// NOTE: settingEngine is a copy so that the caller's one is not changed
+	settingEngine.DetachDataChannels()
+	return NewPeerConnection(settingEngine, configuration)
 }
 
 func stdinToDataChannel(logger *log.Logger, dataChannel *webrtc.DataChannel) error {
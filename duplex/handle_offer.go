@@ -3,19 +3,22 @@
 package duplex
 
 import (
+	"context"
 	"fmt"
+	connection_path "github.com/nwtgck/go-webrtc-piping/connection-path"
 	piping_webrtc_signaling "github.com/nwtgck/go-webrtc-piping/piping-webrtc-signaling"
 	"github.com/pion/webrtc/v3"
 	"log"
+	"net"
 	"net/http"
 )
 
-func HandleOffer(logger *log.Logger, httpClient *http.Client, pipingServerUrl string, httpHeaders [][]string, localId string, remoteId string, webrtcConfig webrtc.Configuration) error {
+func HandleOffer(logger *log.Logger, pathLogger *log.Logger, resolver *net.Resolver, httpClient *http.Client, pipingServerUrl string, httpHeaders [][]string, localId string, remoteId string, settingEngine webrtc.SettingEngine, webrtcConfig webrtc.Configuration, candidateTypes []webrtc.ICECandidateType) error {
 	logger.Printf("offer-side")
 	errCh := make(chan error)
 
 	// Create a new RTCPeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(webrtcConfig)
+	peerConnection, err := NewPeerConnection(settingEngine, webrtcConfig)
 	if err != nil {
 		return err
 	}
@@ -31,14 +34,17 @@ func HandleOffer(logger *log.Logger, httpClient *http.Client, pipingServerUrl st
 		return err
 	}
 
+	pathReporter := connection_path.NewReporter(pathLogger, peerConnection, webrtcConfig.ICEServers, resolver)
+
 	// Set the handler for Peer connection state
 	// This will notify you when the peer has connected/disconnected
 	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
 		logger.Printf("Peer Connection State has changed: %s\n", s.String())
+		pathReporter.OnConnectionStateChange(s)
 
 		switch s {
 		case webrtc.PeerConnectionStateFailed:
-			// Wait until PeerConnection has had no network activity for 30 seconds or another failure. It may be reconnected using an ICE Restart.
+			// Wait until PeerConnection has had no network activity for --ice-disconnected-timeout and --ice-failed-timeout or another failure. It may be reconnected using an ICE Restart.
 			// Use webrtc.PeerConnectionStateDisconnected if you are interested in detecting faster timeout.
 			// Note that the PeerConnection may come back from PeerConnectionStateDisconnected.
 			logger.Println("Peer Connection has gone to failed exiting")
@@ -73,7 +79,7 @@ func HandleOffer(logger *log.Logger, httpClient *http.Client, pipingServerUrl st
 	}()
 
 	go func() {
-		offer, err := piping_webrtc_signaling.NewOffer(logger, httpClient, pipingServerUrl, httpHeaders, peerConnection, localId, remoteId)
+		offer, err := piping_webrtc_signaling.NewOffer(context.Background(), logger, httpClient, pipingServerUrl, httpHeaders, peerConnection, localId, remoteId, candidateTypes)
 		if err != nil {
 			errCh <- err
 			return
@@ -1,6 +1,7 @@
 package piping_webrtc_signaling
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/pion/webrtc/v3"
@@ -8,30 +9,34 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
-	"time"
 )
 
 type Answer struct {
+	ctx             context.Context
 	pipingServerUrl *url.URL
 	httpHeaders     [][]string
 	peerConnection  *webrtc.PeerConnection
 	answerSideId    string
 	offerSideId     string
+	candidateTypes  []webrtc.ICECandidateType
 	logger          *log.Logger
 	httpClient      *http.Client
 }
 
-func NewAnswer(logger *log.Logger, httpClient *http.Client, pipingServerUrlStr string, httpHeaders [][]string, peerConnection *webrtc.PeerConnection, answerSideId string, offerSideId string) (*Answer, error) {
+// NewAnswer creates signaling, which stops when ctx is done
+func NewAnswer(ctx context.Context, logger *log.Logger, httpClient *http.Client, pipingServerUrlStr string, httpHeaders [][]string, peerConnection *webrtc.PeerConnection, answerSideId string, offerSideId string, candidateTypes []webrtc.ICECandidateType) (*Answer, error) {
 	pipingServerUrl, err := url.Parse(pipingServerUrlStr)
 	if err != nil {
 		return nil, err
 	}
 	return &Answer{
+		ctx:             ctx,
 		pipingServerUrl: pipingServerUrl,
 		httpHeaders:     httpHeaders,
 		peerConnection:  peerConnection,
 		answerSideId:    answerSideId,
 		offerSideId:     offerSideId,
+		candidateTypes:  candidateTypes,
 		logger:          logger,
 		httpClient:      httpClient,
 	}, nil
@@ -39,6 +44,13 @@ func NewAnswer(logger *log.Logger, httpClient *http.Client, pipingServerUrlStr s
 
 func (a *Answer) Start() error {
 	errCh := make(chan error)
+	// NOTE: Senders are released after ctx is done not to leak goroutines
+	reportErr := func(err error) {
+		select {
+		case errCh <- err:
+		case <-a.ctx.Done():
+		}
+	}
 	var wg sync.WaitGroup
 
 	candidatesMux := sync.Mutex{}
@@ -58,7 +70,7 @@ func (a *Answer) Start() error {
 				return
 			}
 			if err := a.sendCandidates([]*webrtc.ICECandidate{}); err != nil {
-				errCh <- err
+				reportErr(err)
 				return
 			}
 			notifiedCandidateFinish = true
@@ -68,14 +80,14 @@ func (a *Answer) Start() error {
 		if desc == nil {
 			pendingCandidates = append(pendingCandidates, c)
 		} else if err := a.sendCandidates([]*webrtc.ICECandidate{c}); err != nil {
-			errCh <- err
+			reportErr(err)
 		}
 	})
 
 	var offerInitial OfferInitialJson
 	for {
 		err := func() error {
-			offerInitialBytes, err := httpGetWithHeaders(a.httpClient, urlJoin(a.pipingServerUrl, sha256String(fmt.Sprintf("%s-%s", a.offerSideId, a.answerSideId))), a.httpHeaders)
+			offerInitialBytes, err := httpGetWithHeaders(a.ctx, a.httpClient, urlJoin(a.pipingServerUrl, sha256String(fmt.Sprintf("%s-%s", a.offerSideId, a.answerSideId))), a.httpHeaders)
 			if err != nil {
 				return err
 			}
@@ -86,7 +98,9 @@ func (a *Answer) Start() error {
 		}()
 		if err != nil {
 			a.logger.Printf("error: %+v", err)
-			time.Sleep(3 * time.Second)
+			if !waitRetry(a.ctx) {
+				return a.ctx.Err()
+			}
 			continue
 		}
 		break
@@ -99,10 +113,12 @@ func (a *Answer) Start() error {
 		return err
 	}
 	for {
-		err := pipingPostJson(a.httpClient, urlJoin(a.pipingServerUrl, sha256String(fmt.Sprintf("%s-%s", a.answerSideId, a.offerSideId))), a.httpHeaders, answerInitialBytes)
+		err := pipingPostJson(a.ctx, a.httpClient, urlJoin(a.pipingServerUrl, sha256String(fmt.Sprintf("%s-%s", a.answerSideId, a.offerSideId))), a.httpHeaders, answerInitialBytes)
 		if err != nil {
 			a.logger.Printf("failed to send answerInitial: %+v", err)
-			time.Sleep(3 * time.Second)
+			if !waitRetry(a.ctx) {
+				return a.ctx.Err()
+			}
 			continue
 		}
 		break
@@ -112,18 +128,18 @@ func (a *Answer) Start() error {
 	go func() {
 		defer wg.Done()
 		for {
-			candidates, err := receiveCandidates(a.httpClient, a.pipingServerUrl, a.httpHeaders, a.answerSideId, a.offerSideId)
+			candidates, finished, err := receiveCandidates(a.ctx, a.logger, a.httpClient, a.pipingServerUrl, a.httpHeaders, a.answerSideId, a.offerSideId, a.candidateTypes)
 			if err != nil {
-				errCh <- err
+				reportErr(err)
 				return
 			}
-			if len(candidates) == 0 {
+			if finished {
 				break
 			}
 			a.logger.Printf("candidate received")
 			for _, candidate := range candidates {
 				if err := a.peerConnection.AddICECandidate(candidate); err != nil {
-					errCh <- err
+					reportErr(err)
 					return
 				}
 			}
@@ -136,29 +152,33 @@ func (a *Answer) Start() error {
 		var sdp *webrtc.SessionDescription
 		var err error
 		for {
-			sdp, err = receiveSdp(a.logger, a.httpClient, a.pipingServerUrl, a.httpHeaders, a.answerSideId, a.offerSideId)
+			sdp, err = receiveSdp(a.ctx, a.logger, a.httpClient, a.pipingServerUrl, a.httpHeaders, a.answerSideId, a.offerSideId)
 			if err != nil {
 				a.logger.Printf("failed to receive sdp: %+v", err)
-				time.Sleep(3 * time.Second)
+				if !waitRetry(a.ctx) {
+					return
+				}
 				continue
 			}
 			break
 		}
 		a.logger.Printf("sdp received")
 		if err := a.peerConnection.SetRemoteDescription(*sdp); err != nil {
-			errCh <- err
+			reportErr(err)
 			return
 		}
 		// Create an answer to send to the other process
 		answer, err := a.peerConnection.CreateAnswer(nil)
 		if err != nil {
-			errCh <- err
+			reportErr(err)
 			return
 		}
 		for {
-			if err := sendSdp(a.logger, a.httpClient, a.pipingServerUrl, a.httpHeaders, a.answerSideId, a.offerSideId, &answer); err != nil {
+			if err := sendSdp(a.ctx, a.logger, a.httpClient, a.pipingServerUrl, a.httpHeaders, a.answerSideId, a.offerSideId, &answer); err != nil {
 				a.logger.Printf("failed to send sdp: %+v", err)
-				time.Sleep(3 * time.Second)
+				if !waitRetry(a.ctx) {
+					return
+				}
 				continue
 			}
 			break
@@ -166,7 +186,7 @@ func (a *Answer) Start() error {
 		// Sets the LocalDescription, and starts our UDP listeners
 		err = a.peerConnection.SetLocalDescription(answer)
 		if err != nil {
-			errCh <- err
+			reportErr(err)
 			return
 		}
 		candidatesMux.Lock()
@@ -175,7 +195,9 @@ func (a *Answer) Start() error {
 			for {
 				if err = a.sendCandidates(pendingCandidates); err != nil {
 					a.logger.Printf("failed to send candidates: %+v", err)
-					time.Sleep(3 * time.Second)
+					if !waitRetry(a.ctx) {
+						return
+					}
 					continue
 				}
 				break
@@ -183,16 +205,21 @@ func (a *Answer) Start() error {
 		}
 		if candidateFinished && !notifiedCandidateFinish {
 			if err := a.sendCandidates([]*webrtc.ICECandidate{}); err != nil {
-				errCh <- err
+				reportErr(err)
 			}
 			notifiedCandidateFinish = true
 		}
 	}()
 
 	wg.Wait()
-	return <-errCh
+	select {
+	case err := <-errCh:
+		return err
+	case <-a.ctx.Done():
+		return a.ctx.Err()
+	}
 }
 
 func (a *Answer) sendCandidates(candidates []*webrtc.ICECandidate) error {
-	return sendCandidates(a.logger, a.httpClient, a.pipingServerUrl, a.httpHeaders, a.answerSideId, a.offerSideId, candidates)
+	return sendCandidates(a.ctx, a.logger, a.httpClient, a.pipingServerUrl, a.httpHeaders, a.answerSideId, a.offerSideId, a.candidateTypes, candidates)
 }
@@ -2,6 +2,7 @@ package piping_webrtc_signaling
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
@@ -11,6 +12,8 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
+	"time"
 )
 
 type OfferInitialJson struct {
@@ -32,8 +35,8 @@ func urlJoin(u *url.URL, p ...string) string {
 	return uCloned.String()
 }
 
-func httpGetWithHeaders(httpClient *http.Client, url string, httpHeaders [][]string) ([]byte, error) {
-	req, err := http.NewRequest("GET", url, nil)
+func httpGetWithHeaders(ctx context.Context, httpClient *http.Client, url string, httpHeaders [][]string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -57,8 +60,8 @@ func httpGetWithHeaders(httpClient *http.Client, url string, httpHeaders [][]str
 	return bodyBytes, nil
 }
 
-func pipingPostJson(httpClient *http.Client, url string, httpHeaders [][]string, jsonBytes []byte) error {
-	req, err := http.NewRequest("POST", url, bytes.NewReader(jsonBytes))
+func pipingPostJson(ctx context.Context, httpClient *http.Client, url string, httpHeaders [][]string, jsonBytes []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonBytes))
 	if err != nil {
 		return err
 	}
@@ -82,20 +85,30 @@ func pipingPostJson(httpClient *http.Client, url string, httpHeaders [][]string,
 	return nil
 }
 
-func sendSdp(logger *log.Logger, httpClient *http.Client, pipingServerUrl *url.URL, httpHeaders [][]string, localId string, remoteId string, description *webrtc.SessionDescription) error {
+// waitRetry waits before retrying signaling and returns false when ctx is done
+func waitRetry(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(3 * time.Second):
+		return true
+	}
+}
+
+func sendSdp(ctx context.Context, logger *log.Logger, httpClient *http.Client, pipingServerUrl *url.URL, httpHeaders [][]string, localId string, remoteId string, description *webrtc.SessionDescription) error {
 	jsonBytes, err := json.Marshal(description)
 	if err != nil {
 		return err
 	}
 	url := urlJoin(pipingServerUrl, fmt.Sprintf("%s-%s/sdp", localId, remoteId))
 	logger.Printf("sending sdp %s to %s...", string(jsonBytes), url)
-	return pipingPostJson(httpClient, url, httpHeaders, jsonBytes)
+	return pipingPostJson(ctx, httpClient, url, httpHeaders, jsonBytes)
 }
 
-func receiveSdp(logger *log.Logger, httpClient *http.Client, pipingServerUrl *url.URL, httpHeaders [][]string, localId string, remoteId string) (*webrtc.SessionDescription, error) {
+func receiveSdp(ctx context.Context, logger *log.Logger, httpClient *http.Client, pipingServerUrl *url.URL, httpHeaders [][]string, localId string, remoteId string) (*webrtc.SessionDescription, error) {
 	url := urlJoin(pipingServerUrl, fmt.Sprintf("%s-%s/sdp", remoteId, localId))
 	logger.Printf("receiving sdp from %s ...", url)
-	sdpBytes, err := httpGetWithHeaders(httpClient, url, httpHeaders)
+	sdpBytes, err := httpGetWithHeaders(ctx, httpClient, url, httpHeaders)
 	if err != nil {
 		return nil, err
 	}
@@ -106,11 +119,43 @@ func receiveSdp(logger *log.Logger, httpClient *http.Client, pipingServerUrl *ur
 	return &sdp, nil
 }
 
-func sendCandidates(logger *log.Logger, httpClient *http.Client, pipingServerUrl *url.URL, httpHeaders [][]string, localId string, remoteId string, cs []*webrtc.ICECandidate) error {
+// candidateTypeAllowed returns true when candidateTypes is empty, which means all types are allowed
+func candidateTypeAllowed(candidateTypes []webrtc.ICECandidateType, candidateType webrtc.ICECandidateType) bool {
+	if len(candidateTypes) == 0 {
+		return true
+	}
+	for _, t := range candidateTypes {
+		if t == candidateType {
+			return true
+		}
+	}
+	return false
+}
+
+// candidateInitType parses the type from "typ" field such as "candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host"
+func candidateInitType(candidate webrtc.ICECandidateInit) (webrtc.ICECandidateType, error) {
+	fields := strings.Fields(candidate.Candidate)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "typ" {
+			return webrtc.NewICECandidateType(fields[i+1])
+		}
+	}
+	return 0, fmt.Errorf("candidate type not found: %s", candidate.Candidate)
+}
+
+func sendCandidates(ctx context.Context, logger *log.Logger, httpClient *http.Client, pipingServerUrl *url.URL, httpHeaders [][]string, localId string, remoteId string, candidateTypes []webrtc.ICECandidateType, cs []*webrtc.ICECandidate) error {
 	var candidateJsons []webrtc.ICECandidateInit
 	for _, c := range cs {
+		if !candidateTypeAllowed(candidateTypes, c.Typ) {
+			logger.Printf("candidate filtered: %s", c)
+			continue
+		}
 		candidateJsons = append(candidateJsons, c.ToJSON())
 	}
+	// NOTE: empty candidates mean finish so that not sending when all candidates are filtered
+	if len(cs) != 0 && len(candidateJsons) == 0 {
+		return nil
+	}
 	candidateBytes, err := json.Marshal(&candidateJsons)
 	if err != nil {
 		return err
@@ -120,17 +165,31 @@ func sendCandidates(logger *log.Logger, httpClient *http.Client, pipingServerUrl
 		candidateBytes = []byte("[]")
 	}
 	logger.Printf("sending candidates %s...", string(candidateBytes))
-	return pipingPostJson(httpClient, urlJoin(pipingServerUrl, fmt.Sprintf("%s-%s/candidates", localId, remoteId)), httpHeaders, candidateBytes)
+	return pipingPostJson(ctx, httpClient, urlJoin(pipingServerUrl, fmt.Sprintf("%s-%s/candidates", localId, remoteId)), httpHeaders, candidateBytes)
 }
 
-func receiveCandidates(httpClient *http.Client, pipingServerUrl *url.URL, httpHeaders [][]string, localId string, remoteId string) ([]webrtc.ICECandidateInit, error) {
-	candidateBytes, err := httpGetWithHeaders(httpClient, urlJoin(pipingServerUrl, fmt.Sprintf("%s-%s/candidates", remoteId, localId)), httpHeaders)
+// receiveCandidates returns finished=true when the remote finishes sending candidates
+func receiveCandidates(ctx context.Context, logger *log.Logger, httpClient *http.Client, pipingServerUrl *url.URL, httpHeaders [][]string, localId string, remoteId string, candidateTypes []webrtc.ICECandidateType) (candidates []webrtc.ICECandidateInit, finished bool, err error) {
+	candidateBytes, err := httpGetWithHeaders(ctx, httpClient, urlJoin(pipingServerUrl, fmt.Sprintf("%s-%s/candidates", remoteId, localId)), httpHeaders)
 	if err != nil {
-		return nil, err
-	}
-	var candidates []webrtc.ICECandidateInit
-	if err := json.Unmarshal(candidateBytes, &candidates); err != nil {
-		return nil, err
-	}
-	return candidates, nil
+		return nil, false, err
+	}
+	var received []webrtc.ICECandidateInit
+	if err := json.Unmarshal(candidateBytes, &received); err != nil {
+		return nil, false, err
+	}
+	if len(received) == 0 {
+		return nil, true, nil
+	}
+	for _, candidate := range received {
+		if len(candidateTypes) != 0 {
+			candidateType, err := candidateInitType(candidate)
+			if err != nil || !candidateTypeAllowed(candidateTypes, candidateType) {
+				logger.Printf("candidate filtered: %s", candidate.Candidate)
+				continue
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates, false, nil
 }
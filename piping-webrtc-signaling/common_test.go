@@ -0,0 +1,87 @@
+package piping_webrtc_signaling
+
+import (
+	"context"
+	"github.com/pion/webrtc/v3"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCandidateInitType(t *testing.T) {
+	tests := []struct {
+		candidate string
+		expected  webrtc.ICECandidateType
+		hasError  bool
+	}{
+		{candidate: "candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host", expected: webrtc.ICECandidateTypeHost},
+		{candidate: "candidate:2 1 udp 1694498815 203.0.113.1 50000 typ srflx raddr 192.0.2.1 rport 50000", expected: webrtc.ICECandidateTypeSrflx},
+		{candidate: "candidate:3 1 udp 16777215 203.0.113.2 50000 typ relay raddr 203.0.113.1 rport 50000", expected: webrtc.ICECandidateTypeRelay},
+		{candidate: "candidate:4 1 tcp 1671430143 192.0.2.1 9 typ prflx tcptype active", expected: webrtc.ICECandidateTypePrflx},
+		{candidate: "candidate:5 1 udp 2130706431 192.0.2.1 50000", hasError: true},
+		{candidate: "candidate:6 1 udp 2130706431 192.0.2.1 50000 typ", hasError: true},
+		{candidate: "candidate:7 1 udp 2130706431 192.0.2.1 50000 typ unknown", hasError: true},
+	}
+	for _, test := range tests {
+		actual, err := candidateInitType(webrtc.ICECandidateInit{Candidate: test.candidate})
+		if test.hasError {
+			if err == nil {
+				t.Errorf("candidateInitType(%q) = %s, want error", test.candidate, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("candidateInitType(%q) error: %v", test.candidate, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("candidateInitType(%q) = %s, want %s", test.candidate, actual, test.expected)
+		}
+	}
+}
+
+func TestCandidateTypeAllowed(t *testing.T) {
+	tests := []struct {
+		name           string
+		candidateTypes []webrtc.ICECandidateType
+		candidateType  webrtc.ICECandidateType
+		expected       bool
+	}{
+		{name: "all allowed", candidateTypes: nil, candidateType: webrtc.ICECandidateTypeHost, expected: true},
+		{name: "allowed", candidateTypes: []webrtc.ICECandidateType{webrtc.ICECandidateTypeSrflx, webrtc.ICECandidateTypeRelay}, candidateType: webrtc.ICECandidateTypeRelay, expected: true},
+		{name: "not allowed", candidateTypes: []webrtc.ICECandidateType{webrtc.ICECandidateTypeRelay}, candidateType: webrtc.ICECandidateTypeHost, expected: false},
+	}
+	for _, test := range tests {
+		if actual := candidateTypeAllowed(test.candidateTypes, test.candidateType); actual != test.expected {
+			t.Errorf("%s: candidateTypeAllowed(%v, %s) = %v, want %v", test.name, test.candidateTypes, test.candidateType, actual, test.expected)
+		}
+	}
+}
+
+func TestReceiveCandidatesFiltersCandidateTypes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `[{"candidate": "candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host"}, {"candidate": "candidate:3 1 udp 16777215 203.0.113.2 50000 typ relay raddr 203.0.113.1 rport 50000"}, {"candidate": "candidate:5 1 udp 2130706431 192.0.2.1 50000"}]`)
+	}))
+	defer server.Close()
+	serverUrl, _ := url.Parse(server.URL)
+	logger := log.New(io.Discard, "", 0)
+
+	candidates, finished, err := receiveCandidates(context.Background(), logger, server.Client(), serverUrl, nil, "local", "remote", []webrtc.ICECandidateType{webrtc.ICECandidateTypeRelay})
+	if err != nil {
+		t.Fatalf("receiveCandidates() error: %v", err)
+	}
+	if finished || len(candidates) != 1 || !strings.Contains(candidates[0].Candidate, "typ relay") {
+		t.Errorf("only the relay candidate should be received: %v, finished=%v", candidates, finished)
+	}
+	candidates, _, err = receiveCandidates(context.Background(), logger, server.Client(), serverUrl, nil, "local", "remote", nil)
+	if err != nil {
+		t.Fatalf("receiveCandidates() error: %v", err)
+	}
+	if len(candidates) != 3 {
+		t.Errorf("all candidates should be received without candidate types: %v", candidates)
+	}
+}
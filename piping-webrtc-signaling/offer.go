@@ -1,6 +1,7 @@
 package piping_webrtc_signaling
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/pion/webrtc/v3"
@@ -8,30 +9,34 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
-	"time"
 )
 
 type Offer struct {
+	ctx             context.Context
 	pipingServerUrl *url.URL
 	httpHeaders     [][]string
 	peerConnection  *webrtc.PeerConnection
 	offerSideId     string
 	answerSideId    string
+	candidateTypes  []webrtc.ICECandidateType
 	logger          *log.Logger
 	httpClient      *http.Client
 }
 
-func NewOffer(logger *log.Logger, httpClient *http.Client, pipingServerUrlStr string, httpHeaders [][]string, peerConnection *webrtc.PeerConnection, offerSideId string, answerSideId string) (*Offer, error) {
+// NewOffer creates signaling, which stops when ctx is done
+func NewOffer(ctx context.Context, logger *log.Logger, httpClient *http.Client, pipingServerUrlStr string, httpHeaders [][]string, peerConnection *webrtc.PeerConnection, offerSideId string, answerSideId string, candidateTypes []webrtc.ICECandidateType) (*Offer, error) {
 	pipingServerUrl, err := url.Parse(pipingServerUrlStr)
 	if err != nil {
 		return nil, err
 	}
 	return &Offer{
+		ctx:             ctx,
 		pipingServerUrl: pipingServerUrl,
 		httpHeaders:     httpHeaders,
 		peerConnection:  peerConnection,
 		offerSideId:     offerSideId,
 		answerSideId:    answerSideId,
+		candidateTypes:  candidateTypes,
 		logger:          logger,
 		httpClient:      httpClient,
 	}, nil
@@ -39,6 +44,13 @@ func NewOffer(logger *log.Logger, httpClient *http.Client, pipingServerUrlStr st
 
 func (o *Offer) Start() error {
 	errCh := make(chan error)
+	// NOTE: Senders are released after ctx is done not to leak goroutines
+	reportErr := func(err error) {
+		select {
+		case errCh <- err:
+		case <-o.ctx.Done():
+		}
+	}
 	var wg sync.WaitGroup
 
 	candidatesMux := sync.Mutex{}
@@ -60,7 +72,7 @@ func (o *Offer) Start() error {
 				return
 			}
 			if err := o.sendCandidates([]*webrtc.ICECandidate{}); err != nil {
-				errCh <- err
+				reportErr(err)
 				return
 			}
 			notifiedCandidateFinish = true
@@ -70,7 +82,7 @@ func (o *Offer) Start() error {
 		if desc == nil {
 			pendingCandidates = append(pendingCandidates, c)
 		} else if err := o.sendCandidates([]*webrtc.ICECandidate{c}); err != nil {
-			errCh <- err
+			reportErr(err)
 		}
 	})
 
@@ -88,10 +100,12 @@ func (o *Offer) Start() error {
 		return err
 	}
 	for {
-		err := pipingPostJson(o.httpClient, urlJoin(o.pipingServerUrl, sha256String(fmt.Sprintf("%s-%s", o.offerSideId, o.answerSideId))), o.httpHeaders, offerInitialBytes)
+		err := pipingPostJson(o.ctx, o.httpClient, urlJoin(o.pipingServerUrl, sha256String(fmt.Sprintf("%s-%s", o.offerSideId, o.answerSideId))), o.httpHeaders, offerInitialBytes)
 		if err != nil {
 			o.logger.Printf("failed to send offerInitial: %+v", err)
-			time.Sleep(3 * time.Second)
+			if !waitRetry(o.ctx) {
+				return o.ctx.Err()
+			}
 			continue
 		}
 		break
@@ -99,7 +113,7 @@ func (o *Offer) Start() error {
 	var answerInitial AnswerInitialJson
 	for {
 		err := func() error {
-			answerInitialBytes, err := httpGetWithHeaders(o.httpClient, urlJoin(o.pipingServerUrl, sha256String(fmt.Sprintf("%s-%s", o.answerSideId, o.offerSideId))), o.httpHeaders)
+			answerInitialBytes, err := httpGetWithHeaders(o.ctx, o.httpClient, urlJoin(o.pipingServerUrl, sha256String(fmt.Sprintf("%s-%s", o.answerSideId, o.offerSideId))), o.httpHeaders)
 			if err != nil {
 				return err
 			}
@@ -110,7 +124,9 @@ func (o *Offer) Start() error {
 		}()
 		if err != nil {
 			o.logger.Printf("error: %+v", err)
-			time.Sleep(3 * time.Second)
+			if !waitRetry(o.ctx) {
+				return o.ctx.Err()
+			}
 			continue
 		}
 		break
@@ -124,17 +140,17 @@ func (o *Offer) Start() error {
 	go func() {
 		defer wg.Done()
 		for {
-			candidates, err := receiveCandidates(o.httpClient, o.pipingServerUrl, o.httpHeaders, o.offerSideId, o.answerSideId)
+			candidates, finished, err := receiveCandidates(o.ctx, o.logger, o.httpClient, o.pipingServerUrl, o.httpHeaders, o.offerSideId, o.answerSideId, o.candidateTypes)
 			if err != nil {
-				errCh <- err
+				reportErr(err)
 				return
 			}
-			if len(candidates) == 0 {
+			if finished {
 				break
 			}
 			for _, candidate := range candidates {
 				if err := o.peerConnection.AddICECandidate(candidate); err != nil {
-					errCh <- err
+					reportErr(err)
 					return
 				}
 			}
@@ -147,17 +163,19 @@ func (o *Offer) Start() error {
 		var sdp *webrtc.SessionDescription
 		var err error
 		for {
-			sdp, err = receiveSdp(o.logger, o.httpClient, o.pipingServerUrl, o.httpHeaders, o.offerSideId, o.answerSideId)
+			sdp, err = receiveSdp(o.ctx, o.logger, o.httpClient, o.pipingServerUrl, o.httpHeaders, o.offerSideId, o.answerSideId)
 			if err != nil {
 				o.logger.Printf("failed to receive sdp: %+v", err)
-				time.Sleep(3 * time.Second)
+				if !waitRetry(o.ctx) {
+					return
+				}
 				continue
 			}
 			break
 		}
 		o.logger.Printf("sdp received")
 		if err := o.peerConnection.SetRemoteDescription(*sdp); err != nil {
-			errCh <- err
+			reportErr(err)
 			return
 		}
 		candidatesMux.Lock()
@@ -166,7 +184,9 @@ func (o *Offer) Start() error {
 			for {
 				if err := o.sendCandidates(pendingCandidates); err != nil {
 					o.logger.Printf("failed to send candidates")
-					time.Sleep(3 * time.Second)
+					if !waitRetry(o.ctx) {
+						return
+					}
 					continue
 				}
 				break
@@ -174,25 +194,32 @@ func (o *Offer) Start() error {
 		}
 		if candidateFinished && !notifiedCandidateFinish {
 			if err := o.sendCandidates([]*webrtc.ICECandidate{}); err != nil {
-				errCh <- err
+				reportErr(err)
 			}
 			notifiedCandidateFinish = true
 		}
 	}()
 
 	for {
-		if err := sendSdp(o.logger, o.httpClient, o.pipingServerUrl, o.httpHeaders, o.offerSideId, o.answerSideId, &offer); err != nil {
+		if err := sendSdp(o.ctx, o.logger, o.httpClient, o.pipingServerUrl, o.httpHeaders, o.offerSideId, o.answerSideId, &offer); err != nil {
 			o.logger.Printf("error: %+v", err)
-			time.Sleep(3 * time.Second)
+			if !waitRetry(o.ctx) {
+				return o.ctx.Err()
+			}
 			continue
 		}
 		break
 	}
 
 	wg.Wait()
-	return <-errCh
+	select {
+	case err := <-errCh:
+		return err
+	case <-o.ctx.Done():
+		return o.ctx.Err()
+	}
 }
 
 func (o *Offer) sendCandidates(candidates []*webrtc.ICECandidate) error {
-	return sendCandidates(o.logger, o.httpClient, o.pipingServerUrl, o.httpHeaders, o.offerSideId, o.answerSideId, candidates)
+	return sendCandidates(o.ctx, o.logger, o.httpClient, o.pipingServerUrl, o.httpHeaders, o.offerSideId, o.answerSideId, o.candidateTypes, candidates)
 }
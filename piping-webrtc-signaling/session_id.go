@@ -0,0 +1,62 @@
+package piping_webrtc_signaling
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// SessionIdJson is sent from a peer joining a hub to the hub
+// Both peers use the session ID to derive their own signaling path.
+type SessionIdJson struct {
+	SessionId string `json:"sessionId"`
+}
+
+func NewSessionId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SendSessionId blocks until the hub receives the session ID
+func SendSessionId(logger *log.Logger, httpClient *http.Client, pipingServerUrlStr string, httpHeaders [][]string, hubId string, sessionId string) error {
+	pipingServerUrl, err := url.Parse(pipingServerUrlStr)
+	if err != nil {
+		return err
+	}
+	jsonBytes, err := json.Marshal(SessionIdJson{SessionId: sessionId})
+	if err != nil {
+		return err
+	}
+	logger.Printf("sending session ID %s to hub...", sessionId)
+	return pipingPostJson(context.Background(), httpClient, urlJoin(pipingServerUrl, sha256String(hubId)), httpHeaders, jsonBytes)
+}
+
+// ReceiveSessionId blocks until a peer joins the hub
+func ReceiveSessionId(logger *log.Logger, httpClient *http.Client, pipingServerUrlStr string, httpHeaders [][]string, hubId string) (string, error) {
+	pipingServerUrl, err := url.Parse(pipingServerUrlStr)
+	if err != nil {
+		return "", err
+	}
+	logger.Printf("waiting for a peer joining hub...")
+	jsonBytes, err := httpGetWithHeaders(context.Background(), httpClient, urlJoin(pipingServerUrl, sha256String(hubId)), httpHeaders)
+	if err != nil {
+		return "", err
+	}
+	var sessionIdJson SessionIdJson
+	if err := json.Unmarshal(jsonBytes, &sessionIdJson); err != nil {
+		return "", err
+	}
+	// NOTE: The session ID is a part of signaling paths
+	if _, err := hex.DecodeString(sessionIdJson.SessionId); err != nil || sessionIdJson.SessionId == "" {
+		return "", fmt.Errorf("invalid session ID: %s", sessionIdJson.SessionId)
+	}
+	return sessionIdJson.SessionId, nil
+}
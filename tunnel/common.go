@@ -1,8 +1,31 @@
 package tunnel
 
 import (
+	"fmt"
+	piping_webrtc_signaling "github.com/nwtgck/go-webrtc-piping/piping-webrtc-signaling"
 	"github.com/pion/interceptor"
 	"github.com/pion/webrtc/v3"
+	"log"
+	"net/http"
+	"time"
+)
+
+// persistentRetryInterval is the interval before the next signaling in persistent mode
+const persistentRetryInterval = time.Second
+
+// hubSignalingTimeout is the time for a peer joining a hub to connect
+// Both peers start signaling right after the session ID is received, so a longer wait means the peer has gone.
+const hubSignalingTimeout = 30 * time.Second
+
+type PeerMode int64
+
+const (
+	// PeerModeSingle pairs a listener and a dialer on a path
+	PeerModeSingle PeerMode = iota
+	// PeerModeHub accepts multiple peers joining a path concurrently
+	PeerModeHub
+	// PeerModeJoin joins a hub on a path
+	PeerModeJoin
 )
 
 type NetworkType int64
@@ -12,7 +35,27 @@ const (
 	NetworkTypeUdp
 )
 
-func NewDetachablePeerConnection(configuration webrtc.Configuration) (*webrtc.PeerConnection, error) {
+func (t NetworkType) String() string {
+	switch t {
+	case NetworkTypeTcp:
+		return "tcp"
+	case NetworkTypeUdp:
+		return "udp"
+	}
+	return fmt.Sprintf("NetworkType(%d)", int64(t))
+}
+
+func parseNetworkType(s string) (NetworkType, error) {
+	switch s {
+	case "tcp":
+		return NetworkTypeTcp, nil
+	case "udp":
+		return NetworkTypeUdp, nil
+	}
+	return 0, fmt.Errorf("unknown network type: %s", s)
+}
+
+func NewPeerConnection(settingEngine webrtc.SettingEngine, configuration webrtc.Configuration) (*webrtc.PeerConnection, error) {
 	m := &webrtc.MediaEngine{}
 	if err := m.RegisterDefaultCodecs(); err != nil {
 		return nil, err
@@ -23,13 +66,14 @@ func NewDetachablePeerConnection(configuration webrtc.Configuration) (*webrtc.Pe
 		return nil, err
 	}
 
-	s := webrtc.SettingEngine{}
-	s.DetachDataChannels()
-
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s))
-	//api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(settingEngine))
 	return api.NewPeerConnection(configuration)
-	//return webrtc.NewPeerConnection(configuration)
+}
+
+func NewDetachablePeerConnection(settingEngine webrtc.SettingEngine, configuration webrtc.Configuration) (*webrtc.PeerConnection, error) {
+	// NOTE: settingEngine is a copy so that the caller's one is not changed
+	settingEngine.DetachDataChannels()
+	return NewPeerConnection(settingEngine, configuration)
 }
 
 func offerSideId(path string) string {
@@ -39,3 +83,46 @@ func offerSideId(path string) string {
 func answerSideId(path string) string {
 	return "answer_" + path
 }
+
+func hubId(path string) string {
+	return "hub_" + path
+}
+
+// sessionPath is the signaling path of the peer joining the hub
+func sessionPath(path string, sessionId string) string {
+	return path + "/" + sessionId
+}
+
+// joinHub sends a new session ID to the hub and returns the signaling path of the session
+func joinHub(logger *log.Logger, httpClient *http.Client, pipingServerUrl string, httpHeaders [][]string, path string) (string, error) {
+	sessionId, err := piping_webrtc_signaling.NewSessionId()
+	if err != nil {
+		return "", err
+	}
+	for {
+		// NOTE: Piping Server rejects the sender while another peer is joining
+		if err := piping_webrtc_signaling.SendSessionId(logger, httpClient, pipingServerUrl, httpHeaders, hubId(path), sessionId); err != nil {
+			logger.Printf("failed to join hub: %+v", err)
+			time.Sleep(3 * time.Second)
+			continue
+		}
+		return sessionPath(path, sessionId), nil
+	}
+}
+
+// serveHub calls serve with the signaling path of each peer joining the hub
+func serveHub(logger *log.Logger, httpClient *http.Client, pipingServerUrl string, httpHeaders [][]string, path string, serve func(signalingPath string, signalingTimeout time.Duration) error) {
+	for {
+		sessionId, err := piping_webrtc_signaling.ReceiveSessionId(logger, httpClient, pipingServerUrl, httpHeaders, hubId(path))
+		if err != nil {
+			logger.Printf("failed to receive session ID: %+v", err)
+			time.Sleep(3 * time.Second)
+			continue
+		}
+		logger.Printf("peer joined: session %s", sessionId)
+		go func() {
+			err := serve(sessionPath(path, sessionId), hubSignalingTimeout)
+			logger.Printf("peer has gone: session %s (%v)", sessionId, err)
+		}()
+	}
+}
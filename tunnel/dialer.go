@@ -3,28 +3,91 @@
 package tunnel
 
 import (
+	"context"
 	"fmt"
+	connection_path "github.com/nwtgck/go-webrtc-piping/connection-path"
 	piping_webrtc_signaling "github.com/nwtgck/go-webrtc-piping/piping-webrtc-signaling"
 	"github.com/pion/webrtc/v3"
-	"io"
 	"log"
 	"net"
 	"net/http"
-	"strconv"
+	"os"
+	"time"
 )
 
-func Dialer(logger *log.Logger, httpClient *http.Client, pipingServerUrl string, httpHeaders [][]string, networkType NetworkType, port uint16, path string, webrtcConfig webrtc.Configuration) error {
+// DialerOptions is the options of Dialer, the answer side
+type DialerOptions struct {
+	Logger          *log.Logger
+	PathLogger      *log.Logger
+	Resolver        *net.Resolver
+	HttpClient      *http.Client
+	PipingServerUrl string
+	HttpHeaders     [][]string
+	NetworkType     NetworkType
+	// Target of streams without target. Empty means that the target is required.
+	DefaultTarget string
+	// Patterns of targets the peer may request other than DefaultTarget
+	AllowedTargets []string
+	// Patterns of listen addresses the peer may request for reverse forwarding
+	AllowedListenAddresses []string
+	// Whether the peer may bind to other than loopback
+	GatewayPorts   bool
+	UnixSocketMode os.FileMode
+	Path           string
+	PeerMode       PeerMode
+	// Whether to wait for a new peer after the peer has gone
+	Persistent    bool
+	DialContext   DialContextFunc
+	SettingEngine webrtc.SettingEngine
+	// Called for each session because TURN REST API credentials are created for each session
+	WebrtcConfigFunc func() (webrtc.Configuration, error)
+	CandidateTypes   []webrtc.ICECandidateType
+}
+
+func Dialer(opts DialerOptions) error {
+	logger := opts.Logger
 	logger.Printf("answer-side")
-	errCh := make(chan error)
+	dial := func(signalingPath string, signalingTimeout time.Duration) error {
+		return dialerSession(opts, signalingPath, signalingTimeout)
+	}
+	if opts.PeerMode == PeerModeHub {
+		serveHub(logger, opts.HttpClient, opts.PipingServerUrl, opts.HttpHeaders, opts.Path, dial)
+		return nil
+	}
+	for {
+		signalingPath := opts.Path
+		var signalingTimeout time.Duration
+		if opts.PeerMode == PeerModeJoin {
+			var err error
+			signalingPath, err = joinHub(logger, opts.HttpClient, opts.PipingServerUrl, opts.HttpHeaders, opts.Path)
+			if err != nil {
+				return err
+			}
+			signalingTimeout = hubSignalingTimeout
+		}
+		err := dial(signalingPath, signalingTimeout)
+		if !opts.Persistent {
+			return err
+		}
+		logger.Printf("peer has gone (%v), waiting for a new peer", err)
+		time.Sleep(persistentRetryInterval)
+	}
+}
+
+// dialerSession serves a peer until the peer has gone
+// Zero signalingTimeout means waiting for the peer without timeout.
+func dialerSession(opts DialerOptions, path string, signalingTimeout time.Duration) error {
+	logger := opts.Logger
+	defaultTarget := opts.DefaultTarget
+	// NOTE: buffered not to block senders after returning
+	errCh := make(chan error, 4)
 
-	var peerConnection *webrtc.PeerConnection
-	var err error
-	if networkType == NetworkTypeTcp {
-		peerConnection, err = NewDetachablePeerConnection(webrtcConfig)
-	} else {
-		// NOTE: UDP does not need to detach
-		peerConnection, err = webrtc.NewPeerConnection(webrtcConfig)
+	// NOTE: TURN REST API credentials are created for each session
+	webrtcConfig, err := opts.WebrtcConfigFunc()
+	if err != nil {
+		return err
 	}
+	peerConnection, err := NewDetachablePeerConnection(opts.SettingEngine, webrtcConfig)
 	if err != nil {
 		return err
 	}
@@ -34,14 +97,45 @@ func Dialer(logger *log.Logger, httpClient *http.Client, pipingServerUrl string,
 		}
 	}()
 
+	session, err := newSession(logger, peerConnection, false, func(requested NetworkType, target string) (net.Conn, error) {
+		if target == "" {
+			target = defaultTarget
+		}
+		if target == "" {
+			return nil, fmt.Errorf("target is required")
+		}
+		// NOTE: Allowed targets are for both TCP and UDP
+		if !(target == defaultTarget && requested == opts.NetworkType) && !targetAllowed(opts.AllowedTargets, target) {
+			return nil, fmt.Errorf("%s %s is %w", requested, target, errTargetNotAllowed)
+		}
+		return dialTarget(opts.DialContext, requested, target)
+	})
+	if err != nil {
+		return err
+	}
+	defer session.close()
+	go func() {
+		if err := session.waitConnected(signalingTimeout); err != nil {
+			errCh <- err
+		}
+	}()
+	// NOTE: Canceled after the peer has gone not to leave signaling requests waiting on Piping Server
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// NOTE: The peer may ask to listen for reverse forwarding
+	session.allowListen(opts.AllowedListenAddresses, opts.GatewayPorts, opts.UnixSocketMode)
+
+	pathReporter := connection_path.NewReporter(opts.PathLogger, peerConnection, webrtcConfig.ICEServers, opts.Resolver)
+
 	// Set the handler for Peer connection state
 	// This will notify you when the peer has connected/disconnected
 	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
 		logger.Printf("Peer Connection State has changed: %s\n", s.String())
+		pathReporter.OnConnectionStateChange(s)
 
 		switch s {
 		case webrtc.PeerConnectionStateFailed:
-			// Wait until PeerConnection has had no network activity for 30 seconds or another failure. It may be reconnected using an ICE Restart.
+			// Wait until PeerConnection has had no network activity for --ice-disconnected-timeout and --ice-failed-timeout or another failure. It may be reconnected using an ICE Restart.
 			// Use webrtc.PeerConnectionStateDisconnected if you are interested in detecting faster timeout.
 			// Note that the PeerConnection may come back from PeerConnectionStateDisconnected.
 			logger.Printf("Peer Connection has gone to failed exiting")
@@ -50,15 +144,12 @@ func Dialer(logger *log.Logger, httpClient *http.Client, pipingServerUrl string,
 			errCh <- nil
 		}
 	})
-	switch networkType {
-	case NetworkTypeTcp:
-		tcpDialer(logger, peerConnection, port)
-	case NetworkTypeUdp:
-		udpDialer(logger, peerConnection, port)
-	}
+	go func() {
+		errCh <- session.run()
+	}()
 
 	go func() {
-		answer, err := piping_webrtc_signaling.NewAnswer(logger, httpClient, pipingServerUrl, httpHeaders, peerConnection, answerSideId(path), offerSideId(path))
+		answer, err := piping_webrtc_signaling.NewAnswer(ctx, logger, opts.HttpClient, opts.PipingServerUrl, opts.HttpHeaders, peerConnection, answerSideId(path), offerSideId(path), opts.CandidateTypes)
 		if err != nil {
 			errCh <- err
 			return
@@ -70,63 +161,3 @@ func Dialer(logger *log.Logger, httpClient *http.Client, pipingServerUrl string,
 
 	return <-errCh
 }
-
-func tcpDialer(logger *log.Logger, peerConnection *webrtc.PeerConnection, port uint16) {
-	// Register data channel creation handling
-	peerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
-		logger.Printf("OnDataChannel")
-		// Register channel opening handling
-		d.OnOpen(func() {
-			logger.Printf("OnOpen")
-			raw, err := d.Detach()
-			if err != nil {
-				logger.Printf("failed to detach: %+v", err)
-				return
-			}
-			conn, err := net.Dial("tcp", ":"+strconv.Itoa(int(port)))
-			if err != nil {
-				logger.Printf("failed to dial", err)
-				raw.Close()
-				return
-			}
-			go io.Copy(raw, conn)
-			go io.Copy(conn, raw)
-		})
-	})
-}
-
-func udpDialer(logger *log.Logger, peerConnection *webrtc.PeerConnection, port uint16) {
-	// Register data channel creation handling
-	peerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
-		logger.Printf("OnDataChannel")
-		// TODO: hard code: 127.0.0.1
-		conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
-		if err != nil {
-			log.Printf("failed to dial: %v", err)
-			d.Close()
-			return
-		}
-		// Register channel opening handling
-		d.OnOpen(func() {
-			logger.Printf("data channel OnOpen")
-			var buf [65536]byte
-			for {
-				n, err := conn.Read(buf[:])
-				if err != nil {
-					logger.Printf("failed to read: %+v", err)
-					return
-				}
-				if err := d.Send(buf[:n]); err != nil {
-					logger.Printf("failed to send: %+v", err)
-					return
-				}
-			}
-		})
-
-		d.OnMessage(func(msg webrtc.DataChannelMessage) {
-			if _, err := conn.Write(msg.Data); err != nil {
-				logger.Printf("failed to write: %+v", err)
-			}
-		})
-	})
-}
@@ -0,0 +1,190 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// DefaultBindAddress is loopback not to expose the tunnel to the LAN
+const DefaultBindAddress = "127.0.0.1"
+
+type ForwardMode int64
+
+const (
+	// ForwardModePort forwards to the fixed target
+	ForwardModePort ForwardMode = iota
+	// ForwardModeSocks5 forwards to the target requested by SOCKS5
+	ForwardModeSocks5
+	// ForwardModeHttpProxy forwards to the target requested by HTTP proxy
+	ForwardModeHttpProxy
+)
+
+// Forward forwards the local port to the target on the dialer side
+type Forward struct {
+	Mode ForwardMode
+	// Empty means all interfaces
+	BindAddress string
+	LocalPort   uint16
+	// Non-empty means the Unix domain socket instead of the port. "@" prefix means the abstract socket.
+	UnixSocketPath string
+	// Zero means the default by umask
+	UnixSocketMode os.FileMode
+	// Empty target means the default target of the dialer
+	Target string
+}
+
+// ParseForward parses "[bindAddress:]localPort:remoteTarget" such as "15432:5432", "15432:db.internal:5432", "[::1]:15432:5432" and "unix:/tmp/docker.sock:unix:/var/run/docker.sock"
+func ParseForward(s string, defaultBindAddress string) (Forward, error) {
+	listenAddress, target, err := splitForward(s)
+	if err != nil {
+		return Forward{}, err
+	}
+	forward, err := ParseListenAddress(listenAddress, defaultBindAddress)
+	if err != nil {
+		return Forward{}, err
+	}
+	forward.Target = target
+	return forward, nil
+}
+
+// splitForward splits "[bindAddress:]port:target" into "[bindAddress:]port" and the target
+// A leading non-numeric token is the bind address.
+func splitForward(s string) (listenAddress string, target string, err error) {
+	if strings.HasPrefix(s, unixPrefix) {
+		return splitUnixForward(s)
+	}
+	rest := s
+	if strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]:")
+		if end == -1 {
+			return "", "", fmt.Errorf("invalid forward %s: missing ]", s)
+		}
+		rest = rest[end+2:]
+	} else if first, after, ok := strings.Cut(rest, ":"); ok {
+		if _, err := strconv.ParseUint(first, 10, 16); err != nil {
+			rest = after
+		}
+	}
+	portStr, target, ok := strings.Cut(rest, ":")
+	if !ok || target == "" {
+		return "", "", fmt.Errorf("invalid forward %s: [bindAddress:]port:target is required", s)
+	}
+	if err := ValidateTarget(target); err != nil {
+		return "", "", err
+	}
+	return s[:len(s)-len(rest)] + portStr, target, nil
+}
+
+// splitUnixForward splits "unix:path:target" at the first colon of the path
+// NOTE: The path of the listening socket cannot contain colons in -L and -R, but the target can
+func splitUnixForward(s string) (listenAddress string, target string, err error) {
+	unixSocketPath, target, ok := strings.Cut(strings.TrimPrefix(s, unixPrefix), ":")
+	if !ok || unixSocketPath == "" || target == "" {
+		return "", "", fmt.Errorf("invalid forward %s: unix:path:target is required", s)
+	}
+	if err := ValidateTarget(target); err != nil {
+		return "", "", err
+	}
+	return unixPrefix + unixSocketPath, target, nil
+}
+
+// ParseListenAddress parses "[bindAddress:]port" such as "9999", "0.0.0.0:9999", "[::1]:9999" and "*:9999", or "unix:path"
+func ParseListenAddress(s string, defaultBindAddress string) (Forward, error) {
+	if strings.HasPrefix(s, unixPrefix) {
+		unixSocketPath := strings.TrimPrefix(s, unixPrefix)
+		if unixSocketPath == "" {
+			return Forward{}, fmt.Errorf("invalid listen address %s: path is empty", s)
+		}
+		return Forward{UnixSocketPath: unixSocketPath}, nil
+	}
+	bindAddress := defaultBindAddress
+	portStr := s
+	if strings.Contains(s, ":") {
+		var err error
+		bindAddress, portStr, err = net.SplitHostPort(s)
+		if err != nil {
+			return Forward{}, fmt.Errorf("invalid listen address %s: [bindAddress:]port is required", s)
+		}
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return Forward{}, fmt.Errorf("invalid port: %s", portStr)
+	}
+	return Forward{BindAddress: normalizeBindAddress(bindAddress), LocalPort: uint16(port)}, nil
+}
+
+// normalizeBindAddress converts "*" into empty for all interfaces
+func normalizeBindAddress(bindAddress string) string {
+	if bindAddress == "*" {
+		return ""
+	}
+	return bindAddress
+}
+
+func (f Forward) localAddress() string {
+	return net.JoinHostPort(f.BindAddress, strconv.Itoa(int(f.LocalPort)))
+}
+
+// ValidateTarget validates "port", "host:port" or "unix:path"
+// Only port means localhost for backward compatibility.
+func ValidateTarget(target string) error {
+	if strings.HasPrefix(target, unixPrefix) {
+		if target == unixPrefix {
+			return fmt.Errorf("invalid target %s: path is empty", target)
+		}
+		return nil
+	}
+	if _, err := strconv.ParseUint(target, 10, 16); err == nil {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("invalid target %s: port or host:port is required", target)
+	}
+	if host == "" {
+		return fmt.Errorf("invalid target %s: host is empty", target)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port of target %s", target)
+	}
+	return nil
+}
+
+// targetAllowed reports whether the target matches any of the patterns
+// A pattern is the syntax of path.Match such as "80" and "80*".
+func targetAllowed(allowedTargets []string, target string) bool {
+	for _, pattern := range allowedTargets {
+		if matched, _ := path.Match(pattern, target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// DialContextFunc is the signature of net.Dialer.DialContext
+type DialContextFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func dialTarget(dialContext DialContextFunc, networkType NetworkType, target string) (net.Conn, error) {
+	if strings.HasPrefix(target, unixPrefix) {
+		if networkType != NetworkTypeTcp {
+			return nil, fmt.Errorf("Unix domain socket is only for TCP: %s", target)
+		}
+		return dialContext(context.Background(), "unix", strings.TrimPrefix(target, unixPrefix))
+	}
+	address := target
+	if _, err := strconv.ParseUint(target, 10, 16); err == nil {
+		// NOTE: The same as old versions
+		switch networkType {
+		case NetworkTypeTcp:
+			address = ":" + target
+		default:
+			address = net.JoinHostPort("127.0.0.1", target)
+		}
+	}
+	return dialContext(context.Background(), networkType.String(), address)
+}
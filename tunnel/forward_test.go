@@ -0,0 +1,88 @@
+package tunnel
+
+import (
+	"testing"
+)
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Forward
+		hasError bool
+	}{
+		{input: "15432:5432", expected: Forward{BindAddress: DefaultBindAddress, LocalPort: 15432, Target: "5432"}},
+		{input: "15432:db.internal:5432", expected: Forward{BindAddress: DefaultBindAddress, LocalPort: 15432, Target: "db.internal:5432"}},
+		{input: "0.0.0.0:15432:5432", expected: Forward{BindAddress: "0.0.0.0", LocalPort: 15432, Target: "5432"}},
+		{input: "localhost:15432:db.internal:5432", expected: Forward{BindAddress: "localhost", LocalPort: 15432, Target: "db.internal:5432"}},
+		{input: "*:15432:5432", expected: Forward{BindAddress: "", LocalPort: 15432, Target: "5432"}},
+		{input: "[::1]:15432:5432", expected: Forward{BindAddress: "::1", LocalPort: 15432, Target: "5432"}},
+		{input: "[::1]:15432:[fd00::1]:5432", expected: Forward{BindAddress: "::1", LocalPort: 15432, Target: "[fd00::1]:5432"}},
+		{input: "2375:unix:/var/run/docker.sock", expected: Forward{BindAddress: DefaultBindAddress, LocalPort: 2375, Target: "unix:/var/run/docker.sock"}},
+		{input: "unix:/tmp/a.sock:5432", expected: Forward{UnixSocketPath: "/tmp/a.sock", Target: "5432"}},
+		{input: "unix:/tmp/a.sock:db.internal:5432", expected: Forward{UnixSocketPath: "/tmp/a.sock", Target: "db.internal:5432"}},
+		{input: "unix:/tmp/a.sock:unix:/run/b:c.sock", expected: Forward{UnixSocketPath: "/tmp/a.sock", Target: "unix:/run/b:c.sock"}},
+		{input: "unix:@abstract:unix:/run/b.sock", expected: Forward{UnixSocketPath: "@abstract", Target: "unix:/run/b.sock"}},
+		// NOTE: The path of the listening socket ends at its first colon
+		{input: "unix:/tmp/a:b.sock:5432", expected: Forward{UnixSocketPath: "/tmp/a", Target: "b.sock:5432"}},
+		{input: "unix:/tmp/a:b.sock", hasError: true},
+		{input: "unix:/tmp/a.sock", hasError: true},
+		{input: "unix::5432", hasError: true},
+		{input: "15432", hasError: true},
+		{input: "15432:", hasError: true},
+		{input: "15432:db.internal", hasError: true},
+		{input: "15432::5432", hasError: true},
+		{input: "70000:5432", hasError: true},
+		{input: "[::1:15432:5432", hasError: true},
+		{input: "15432:unix:", hasError: true},
+	}
+	for _, test := range tests {
+		actual, err := ParseForward(test.input, DefaultBindAddress)
+		if test.hasError {
+			if err == nil {
+				t.Errorf("ParseForward(%q) = %+v, want error", test.input, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseForward(%q) error: %v", test.input, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("ParseForward(%q) = %+v, want %+v", test.input, actual, test.expected)
+		}
+	}
+}
+
+func TestParseReverseForward(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected ReverseForward
+		hasError bool
+	}{
+		{input: "8080:80", expected: ReverseForward{RemoteAddress: "8080", Target: "80"}},
+		{input: "0.0.0.0:2222:22", expected: ReverseForward{RemoteAddress: "0.0.0.0:2222", Target: "22"}},
+		{input: "[::1]:8080:web.internal:80", expected: ReverseForward{RemoteAddress: "[::1]:8080", Target: "web.internal:80"}},
+		{input: "8080:unix:/run/a.sock", expected: ReverseForward{RemoteAddress: "8080", Target: "unix:/run/a.sock"}},
+		{input: "unix:/tmp/agent.sock:unix:/run/agent.sock", expected: ReverseForward{RemoteAddress: "unix:/tmp/agent.sock", Target: "unix:/run/agent.sock"}},
+		{input: "unix:/tmp/a:b.sock:22", expected: ReverseForward{RemoteAddress: "unix:/tmp/a", Target: "b.sock:22"}},
+		{input: "8080", hasError: true},
+		{input: "host:8080", hasError: true},
+		{input: "abc:80", hasError: true},
+	}
+	for _, test := range tests {
+		actual, err := ParseReverseForward(test.input)
+		if test.hasError {
+			if err == nil {
+				t.Errorf("ParseReverseForward(%q) = %+v, want error", test.input, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseReverseForward(%q) error: %v", test.input, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("ParseReverseForward(%q) = %+v, want %+v", test.input, actual, test.expected)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+)
+
+// httpProxyListener accepts CONNECT and absolute-URI requests and forwards each of them over its own stream
+func httpProxyListener(logger *log.Logger, pool *sessionPool, ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		logger.Printf("accepted HTTP proxy")
+		go func() {
+			if err := handleHttpProxy(pool, conn); err != nil {
+				logger.Printf("HTTP proxy error: %+v", err)
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func handleHttpProxy(pool *sessionPool, conn net.Conn) error {
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return err
+	}
+	if req.Method == http.MethodConnect {
+		raw, err := pool.get().openStream(NetworkTypeTcp, req.Host)
+		if err != nil {
+			writeHttpProxyError(conn, http.StatusBadGateway, err)
+			return err
+		}
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			raw.Close()
+			return err
+		}
+		// NOTE: The client may send data before receiving the response such as TLS ClientHello
+		if reader.Buffered() != 0 {
+			buffered, _ := reader.Peek(reader.Buffered())
+			if _, err := raw.Write(buffered); err != nil {
+				raw.Close()
+				return err
+			}
+		}
+		pipe(conn, raw)
+		return nil
+	}
+
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		writeHttpProxyError(conn, http.StatusBadRequest, fmt.Errorf("absolute http:// URI is required"))
+		return fmt.Errorf("not a proxy request: %s", req.RequestURI)
+	}
+	target := req.URL.Host
+	if req.URL.Port() == "" {
+		target = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	raw, err := pool.get().openStream(NetworkTypeTcp, target)
+	if err != nil {
+		writeHttpProxyError(conn, http.StatusBadGateway, err)
+		return err
+	}
+	// NOTE: One request per stream. Request.Write() writes the origin-form.
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.Close = true
+	if err := req.Write(raw); err != nil {
+		raw.Close()
+		return err
+	}
+	// NOTE: The rest of the client connection is not forwarded
+	if _, err := raw.Write([]byte{}); err != nil {
+		raw.Close()
+		return err
+	}
+	go func() {
+		_ = copyFromStream(conn, raw)
+		conn.Close()
+		raw.Close()
+	}()
+	return nil
+}
+
+func writeHttpProxyError(conn net.Conn, statusCode int, err error) {
+	body := err.Error() + "\n"
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", statusCode, http.StatusText(statusCode), len(body), body)
+}
@@ -3,29 +3,158 @@
 package tunnel
 
 import (
+	"context"
 	"fmt"
+	connection_path "github.com/nwtgck/go-webrtc-piping/connection-path"
 	piping_webrtc_signaling "github.com/nwtgck/go-webrtc-piping/piping-webrtc-signaling"
 	"github.com/pion/webrtc/v3"
 	"io"
 	"log"
 	"net"
 	"net/http"
-	"strconv"
+	"os"
 	"sync"
+	"time"
 )
 
-func Listener(logger *log.Logger, httpClient *http.Client, pipingServerUrl string, httpHeaders [][]string, networkType NetworkType, port uint16, path string, webrtcConfig webrtc.Configuration) error {
+// ListenerOptions is the options of Listener, the offer side
+type ListenerOptions struct {
+	Logger          *log.Logger
+	PathLogger      *log.Logger
+	Resolver        *net.Resolver
+	HttpClient      *http.Client
+	PipingServerUrl string
+	HttpHeaders     [][]string
+	NetworkType     NetworkType
+	Forwards        []Forward
+	ReverseForwards []ReverseForward
+	Path            string
+	PeerMode        PeerMode
+	// Whether to wait for a new peer after the peer has gone
+	Persistent    bool
+	DialContext   DialContextFunc
+	SettingEngine webrtc.SettingEngine
+	// Called for each session because TURN REST API credentials are created for each session
+	WebrtcConfigFunc func() (webrtc.Configuration, error)
+	CandidateTypes   []webrtc.ICECandidateType
+}
+
+func Listener(opts ListenerOptions) error {
+	logger := opts.Logger
+	networkType := opts.NetworkType
+	forwards := opts.Forwards
 	logger.Printf("listener: offer-side")
-	errCh := make(chan error)
-
-	var peerConnection *webrtc.PeerConnection
-	var err error
-	if networkType == NetworkTypeTcp {
-		peerConnection, err = NewDetachablePeerConnection(webrtcConfig)
-	} else {
-		// NOTE: UDP does not need to detach
-		peerConnection, err = webrtc.NewPeerConnection(webrtcConfig)
+	pool := newSessionPool()
+	// NOTE: Local listeners are kept open over sessions in persistent mode
+	listenerErrCh := make(chan error, len(forwards))
+	// NOTE: All forwards share the PeerConnection
+	for _, forward := range forwards {
+		forward := forward
+		if forward.Mode == ForwardModeSocks5 || forward.Mode == ForwardModeHttpProxy {
+			ln, err := forward.listenStream()
+			if err != nil {
+				return err
+			}
+			defer ln.Close()
+			printListening(ln.Addr(), forward)
+			go func() {
+				if forward.Mode == ForwardModeSocks5 {
+					listenerErrCh <- socks5Listener(logger, pool, ln)
+				} else {
+					listenerErrCh <- httpProxyListener(logger, pool, ln)
+				}
+			}()
+			continue
+		}
+		if networkType == NetworkTypeUdp && forward.UnixSocketPath != "" {
+			return fmt.Errorf("Unix domain socket is only for TCP: %s%s", unixPrefix, forward.UnixSocketPath)
+		}
+		switch networkType {
+		case NetworkTypeTcp:
+			ln, err := forward.listenStream()
+			if err != nil {
+				return err
+			}
+			defer ln.Close()
+			printListening(ln.Addr(), forward)
+			go func() {
+				listenerErrCh <- tcpListener(logger, pool, ln, forward)
+			}()
+		case NetworkTypeUdp:
+			laddr, err := net.ResolveUDPAddr("udp", forward.localAddress())
+			if err != nil {
+				return err
+			}
+			conn, err := net.ListenUDP("udp", laddr)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			printListening(conn.LocalAddr(), forward)
+			go func() {
+				listenerErrCh <- udpListener(logger, pool, conn, forward)
+			}()
+		}
 	}
+
+	listen := func(signalingPath string, signalingTimeout time.Duration) error {
+		return listenerSession(opts, signalingPath, signalingTimeout, pool, listenerErrCh)
+	}
+	if opts.PeerMode == PeerModeHub {
+		go serveHub(logger, opts.HttpClient, opts.PipingServerUrl, opts.HttpHeaders, opts.Path, listen)
+		return <-listenerErrCh
+	}
+	for {
+		signalingPath := opts.Path
+		var signalingTimeout time.Duration
+		if opts.PeerMode == PeerModeJoin {
+			var err error
+			signalingPath, err = joinHub(logger, opts.HttpClient, opts.PipingServerUrl, opts.HttpHeaders, opts.Path)
+			if err != nil {
+				return err
+			}
+			signalingTimeout = hubSignalingTimeout
+		}
+		err := listen(signalingPath, signalingTimeout)
+		if !opts.Persistent || len(listenerErrCh) != 0 {
+			return err
+		}
+		logger.Printf("peer has gone (%v), waiting for a new peer", err)
+		time.Sleep(persistentRetryInterval)
+	}
+}
+
+// printListening prints the actual address, which has the port even when port 0 is specified
+func printListening(addr net.Addr, forward Forward) {
+	switch forward.Mode {
+	case ForwardModeSocks5:
+		_, _ = fmt.Fprintf(os.Stderr, "listening on %s %s for SOCKS5\n", addr.Network(), addr)
+		return
+	case ForwardModeHttpProxy:
+		_, _ = fmt.Fprintf(os.Stderr, "listening on %s %s for HTTP proxy\n", addr.Network(), addr)
+		return
+	}
+	if forward.Target == "" {
+		_, _ = fmt.Fprintf(os.Stderr, "listening on %s %s\n", addr.Network(), addr)
+		return
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "listening on %s %s for %s\n", addr.Network(), addr, forward.Target)
+}
+
+// listenerSession serves a peer until the peer has gone
+// Zero signalingTimeout means waiting for the peer without timeout.
+func listenerSession(opts ListenerOptions, path string, signalingTimeout time.Duration, pool *sessionPool, listenerErrCh chan error) error {
+	logger := opts.Logger
+	reverseForwards := opts.ReverseForwards
+	// NOTE: buffered not to block senders after returning
+	errCh := make(chan error, 4)
+
+	// NOTE: TURN REST API credentials are created for each session
+	webrtcConfig, err := opts.WebrtcConfigFunc()
+	if err != nil {
+		return err
+	}
+	peerConnection, err := NewDetachablePeerConnection(opts.SettingEngine, webrtcConfig)
 	if err != nil {
 		return err
 	}
@@ -35,25 +164,47 @@ func Listener(logger *log.Logger, httpClient *http.Client, pipingServerUrl strin
 		}
 	}()
 
-	// Create a datachannel with label 'data'
-	dataChannel, err := peerConnection.CreateDataChannel("data", nil)
-	if err != nil {
-		return err
+	// NOTE: The peer opens streams only for reverse forwards
+	var dial dialFunc
+	if len(reverseForwards) != 0 {
+		dial = reverseForwardsDialFunc(opts.DialContext, opts.NetworkType, reverseForwards)
 	}
-	// NOTE: Close immediately because main purpose of creating the data channel for avoiding empty SDP
-	// TODO: find better way
-	if err := dataChannel.Close(); err != nil {
+	// NOTE: The control channel also makes the offer SDP have an application section
+	session, err := newSession(logger, peerConnection, true, dial)
+	if err != nil {
 		return err
 	}
+	defer func() {
+		session.close()
+		pool.remove(session)
+	}()
+	// NOTE: The session is used by local connections after the control channel opens
+	go func() {
+		if err := session.waitConnected(signalingTimeout); err != nil {
+			errCh <- err
+			return
+		}
+		pool.add(session)
+	}()
+	// NOTE: Canceled after the peer has gone not to leave signaling requests waiting on Piping Server
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pathReporter := connection_path.NewReporter(opts.PathLogger, peerConnection, webrtcConfig.ICEServers, opts.Resolver)
 
 	// Set the handler for Peer connection state
 	// This will notify you when the peer has connected/disconnected
 	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
 		logger.Printf("Peer Connection State has changed: %s\n", s.String())
+		pathReporter.OnConnectionStateChange(s)
 
+		switch s {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			pool.remove(session)
+		}
 		switch s {
 		case webrtc.PeerConnectionStateFailed:
-			// Wait until PeerConnection has had no network activity for 30 seconds or another failure. It may be reconnected using an ICE Restart.
+			// Wait until PeerConnection has had no network activity for --ice-disconnected-timeout and --ice-failed-timeout or another failure. It may be reconnected using an ICE Restart.
 			// Use webrtc.PeerConnectionStateDisconnected if you are interested in detecting faster timeout.
 			// Note that the PeerConnection may come back from PeerConnectionStateDisconnected.
 			logger.Println("Peer Connection has gone to failed exiting")
@@ -64,22 +215,14 @@ func Listener(logger *log.Logger, httpClient *http.Client, pipingServerUrl strin
 	})
 
 	go func() {
-		switch networkType {
-		case NetworkTypeTcp:
-			if err := tcpListener(logger, peerConnection, port); err != nil {
-				errCh <- err
-				return
-			}
-		case NetworkTypeUdp:
-			if err := udpListener(logger, peerConnection, port); err != nil {
-				errCh <- err
-				return
-			}
-		}
+		errCh <- session.run()
 	}()
+	if len(reverseForwards) != 0 {
+		go session.requestListens(opts.NetworkType, reverseForwards)
+	}
 
 	go func() {
-		offer, err := piping_webrtc_signaling.NewOffer(logger, httpClient, pipingServerUrl, httpHeaders, peerConnection, offerSideId(path), answerSideId(path))
+		offer, err := piping_webrtc_signaling.NewOffer(ctx, logger, opts.HttpClient, opts.PipingServerUrl, opts.HttpHeaders, peerConnection, offerSideId(path), answerSideId(path), opts.CandidateTypes)
 		if err != nil {
 			errCh <- err
 			return
@@ -89,99 +232,91 @@ func Listener(logger *log.Logger, httpClient *http.Client, pipingServerUrl strin
 		}
 	}()
 
-	return <-errCh
-}
-
-func tcpListener(logger *log.Logger, peerConnection *webrtc.PeerConnection, port uint16) error {
-	ln, err := net.Listen("tcp", ":"+strconv.Itoa(int(port)))
-	if err != nil {
+	select {
+	case err := <-errCh:
+		return err
+	case err := <-listenerErrCh:
+		// NOTE: Put back for the caller to know that the local listener has stopped
+		listenerErrCh <- err
 		return err
 	}
+}
+
+func tcpListener(logger *log.Logger, pool *sessionPool, ln net.Listener, forward Forward) error {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			return err
 		}
 		logger.Printf("accepted")
-		dataChannel, err := peerConnection.CreateDataChannel("data", nil)
-		if err != nil {
-			return err
-		}
-		dataChannel.OnOpen(func() {
-			logger.Printf("OnOpen in listener")
-			raw, err := dataChannel.Detach()
+		go func() {
+			raw, err := pool.get().openStream(NetworkTypeTcp, forward.Target)
 			if err != nil {
-				logger.Printf("failed to detach: %+v", err)
+				logger.Printf("failed to open stream: %+v", err)
+				conn.Close()
 				return
 			}
-			go io.Copy(raw, conn)
-			go io.Copy(conn, raw)
-		})
+			pipe(conn, raw)
+		}()
 	}
 }
 
-type udpAddrToDataChannelMap struct {
+type udpAddrToStreamMap struct {
 	inner *sync.Map
 }
 
-func (m udpAddrToDataChannelMap) Load(key *net.UDPAddr) *webrtc.DataChannel {
-	dataChannel, ok := m.inner.Load(key.String())
+func (m udpAddrToStreamMap) Load(key *net.UDPAddr) io.ReadWriteCloser {
+	stream, ok := m.inner.Load(key.String())
 	if !ok {
 		return nil
 	}
-	return dataChannel.(*webrtc.DataChannel)
+	return stream.(io.ReadWriteCloser)
 }
 
-func (m udpAddrToDataChannelMap) Store(key *net.UDPAddr, value *webrtc.DataChannel) {
+func (m udpAddrToStreamMap) Store(key *net.UDPAddr, value io.ReadWriteCloser) {
 	m.inner.Store(key.String(), value)
 }
 
-func udpListener(logger *log.Logger, peerConnection *webrtc.PeerConnection, port uint16) error {
-	var ordered = false
-	var maxRetransmits uint16 = 0
-	dataChannelOptions := webrtc.DataChannelInit{
-		Ordered:        &ordered,
-		MaxRetransmits: &maxRetransmits,
-	}
-	raddrToDataChannel := udpAddrToDataChannelMap{inner: new(sync.Map)}
+// Delete deletes the stream unless it has been replaced with a new stream
+func (m udpAddrToStreamMap) Delete(key *net.UDPAddr, value io.ReadWriteCloser) {
+	m.inner.CompareAndDelete(key.String(), value)
+}
 
-	laddr, err := net.ResolveUDPAddr("udp", ":"+strconv.Itoa(int(port)))
-	if err != nil {
-		return err
-	}
-	conn, err := net.ListenUDP("udp", laddr)
-	if err != nil {
-		return err
-	}
+func udpListener(logger *log.Logger, pool *sessionPool, conn *net.UDPConn, forward Forward) error {
+	raddrToStream := udpAddrToStreamMap{inner: new(sync.Map)}
 	var buf [65536]byte
 	for {
 		n, raddr, err := conn.ReadFromUDP(buf[:])
 		if err != nil {
 			return err
 		}
-		dataChannel := raddrToDataChannel.Load(raddr)
-		if dataChannel == nil {
-			dataChannel, err = peerConnection.CreateDataChannel("data", &dataChannelOptions)
+		stream := raddrToStream.Load(raddr)
+		if stream == nil {
+			stream, err = pool.get().openStream(NetworkTypeUdp, forward.Target)
 			if err != nil {
-				return err
+				logger.Printf("failed to open stream: %+v", err)
+				continue
 			}
-
-			dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
-				if _, err := conn.WriteToUDP(msg.Data, raddr); err != nil {
-					logger.Printf("failed to write to UDP: %+v", err)
+			raddrToStream.Store(raddr, stream)
+			go func(raddr *net.UDPAddr, stream io.ReadWriteCloser) {
+				defer raddrToStream.Delete(raddr, stream)
+				var buf [65536]byte
+				for {
+					n, err := stream.Read(buf[:])
+					if err != nil {
+						return
+					}
+					if _, err := conn.WriteToUDP(buf[:n], raddr); err != nil {
+						logger.Printf("failed to write to UDP: %+v", err)
+					}
 				}
-			})
-
-			openedCh := make(chan struct{})
-			dataChannel.OnOpen(func() {
-				raddrToDataChannel.Store(raddr, dataChannel)
-				openedCh <- struct{}{}
-			})
-			<-openedCh
-
+			}(raddr, stream)
 		}
-		if err := dataChannel.Send(buf[:n]); err != nil {
-			return err
+		if _, err := stream.Write(buf[:n]); err != nil {
+			// NOTE: The next datagram opens a new stream
+			logger.Printf("failed to write to stream: %+v", err)
+			raddrToStream.Delete(raddr, stream)
+			stream.Close()
 		}
 	}
 }
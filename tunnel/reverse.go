@@ -0,0 +1,178 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ReverseForward asks the peer to listen and forwards accepted connections to the local target
+type ReverseForward struct {
+	// [bindAddress:]port or unix:path on the peer. The peer decides the default bind address.
+	RemoteAddress string
+	Target        string
+}
+
+// ParseReverseForward parses "[bindAddress:]remotePort:localTarget" such as "8080:80", "0.0.0.0:2222:22" and "unix:/tmp/agent.sock:unix:/run/agent.sock"
+func ParseReverseForward(s string) (ReverseForward, error) {
+	remoteAddress, target, err := splitForward(s)
+	if err != nil {
+		return ReverseForward{}, err
+	}
+	if _, err := ParseListenAddress(remoteAddress, ""); err != nil {
+		return ReverseForward{}, err
+	}
+	return ReverseForward{RemoteAddress: remoteAddress, Target: target}, nil
+}
+
+// reverseForwardsDialFunc allows only the targets of reverseForwards
+func reverseForwardsDialFunc(dialContext DialContextFunc, networkType NetworkType, reverseForwards []ReverseForward) dialFunc {
+	return func(requested NetworkType, target string) (net.Conn, error) {
+		for _, reverseForward := range reverseForwards {
+			if requested == networkType && reverseForward.Target == target {
+				return dialTarget(dialContext, requested, target)
+			}
+		}
+		return nil, fmt.Errorf("%s %s is %w", requested, target, errTargetNotAllowed)
+	}
+}
+
+// listenAddressAllowed reports whether the port, or "unix:path", matches any of the patterns
+// NOTE: Only patterns with "unix:" allow Unix domain sockets
+func listenAddressAllowed(allowedListenAddresses []string, forward Forward) bool {
+	for _, pattern := range allowedListenAddresses {
+		var matched bool
+		if forward.UnixSocketPath != "" {
+			matched = strings.HasPrefix(pattern, unixPrefix) && targetAllowed([]string{pattern}, unixPrefix+forward.UnixSocketPath)
+		} else {
+			matched = !strings.HasPrefix(pattern, unixPrefix) && targetAllowed([]string{pattern}, strconv.Itoa(int(forward.LocalPort)))
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoopbackAddress reports whether the bind address is loopback. Empty means all interfaces.
+func isLoopbackAddress(bindAddress string) bool {
+	if bindAddress == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(bindAddress)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requestListens asks the peer to listen for each reverse forward
+func (s *session) requestListens(networkType NetworkType, reverseForwards []ReverseForward) {
+	if err := s.waitReady(); err != nil {
+		return
+	}
+	for _, reverseForward := range reverseForwards {
+		res, err := s.requestListen(networkType, reverseForward)
+		if err == nil && res.Error != "" {
+			err = errors.New(res.Error)
+		}
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "failed to listen on peer %s for %s: %v\n", reverseForward.RemoteAddress, reverseForward.Target, err)
+			continue
+		}
+		network := networkType.String()
+		if strings.HasPrefix(reverseForward.RemoteAddress, unixPrefix) {
+			network = "unix"
+		}
+		_, _ = fmt.Fprintf(os.Stderr, "peer listening on %s %s for %s\n", network, res.Address, reverseForward.Target)
+	}
+}
+
+func (s *session) requestListen(networkType NetworkType, reverseForward ReverseForward) (controlMessage, error) {
+	id, err := s.newRequestId()
+	if err != nil {
+		return controlMessage{}, err
+	}
+	defer s.releaseStreamId(id)
+	return s.request(controlMessage{Type: controlMessageTypeListen, Id: id, Network: networkType.String(), Target: reverseForward.Target, Address: reverseForward.RemoteAddress})
+}
+
+func (s *session) handleListen(msg controlMessage) {
+	addr, err := s.listenForPeer(msg)
+	if err != nil {
+		s.logger.Printf("failed to listen for peer: %+v", err)
+		if err := s.sendControlMessage(controlMessage{Type: controlMessageTypeListenError, Id: msg.Id, Error: err.Error()}); err != nil {
+			s.logger.Printf("failed to send listen_error: %+v", err)
+		}
+		return
+	}
+	if err := s.sendControlMessage(controlMessage{Type: controlMessageTypeListened, Id: msg.Id, Address: addr.String()}); err != nil {
+		s.logger.Printf("failed to send listened: %+v", err)
+	}
+}
+
+// listenForPeer listens until the session is closed and opens streams to the peer for accepted connections
+func (s *session) listenForPeer(msg controlMessage) (net.Addr, error) {
+	if len(s.allowedListenAddresses) == 0 {
+		return nil, fmt.Errorf("listening is not allowed")
+	}
+	networkType, err := parseNetworkType(msg.Network)
+	if err != nil {
+		return nil, err
+	}
+	defaultBindAddress := DefaultBindAddress
+	if s.listenGatewayPorts {
+		defaultBindAddress = ""
+	}
+	forward, err := ParseListenAddress(msg.Address, defaultBindAddress)
+	if err != nil {
+		return nil, err
+	}
+	if !listenAddressAllowed(s.allowedListenAddresses, forward) {
+		return nil, fmt.Errorf("listen address %s is not allowed", msg.Address)
+	}
+	if forward.UnixSocketPath == "" && !s.listenGatewayPorts && !isLoopbackAddress(forward.BindAddress) {
+		return nil, fmt.Errorf("bind address %s is not allowed without -g", msg.Address)
+	}
+	forward.Target = msg.Target
+	forward.UnixSocketMode = s.listenUnixSocketMode
+	if networkType == NetworkTypeUdp && forward.UnixSocketPath != "" {
+		return nil, fmt.Errorf("Unix domain socket is only for TCP: %s%s", unixPrefix, forward.UnixSocketPath)
+	}
+	// NOTE: Streams of the listener go to this session only
+	pool := newSessionPool()
+	pool.add(s)
+
+	s.listenersMux.Lock()
+	defer s.listenersMux.Unlock()
+	select {
+	case <-s.closedCh:
+		return nil, fmt.Errorf("session closed")
+	default:
+	}
+	var addr net.Addr
+	switch networkType {
+	case NetworkTypeTcp:
+		ln, err := forward.listenStream()
+		if err != nil {
+			return nil, err
+		}
+		s.listeners = append(s.listeners, ln)
+		go tcpListener(s.logger, pool, ln, forward)
+		addr = ln.Addr()
+	case NetworkTypeUdp:
+		laddr, err := net.ResolveUDPAddr("udp", forward.localAddress())
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			return nil, err
+		}
+		s.listeners = append(s.listeners, conn)
+		go udpListener(s.logger, pool, conn, forward)
+		addr = conn.LocalAddr()
+	}
+	printListening(addr, forward)
+	return addr, nil
+}
@@ -0,0 +1,679 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pion/webrtc/v3"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The control channel is pre-negotiated on both sides with the fixed ID.
+// It keeps the SCTP association alive and carries stream-open requests and health pings.
+const (
+	controlChannelLabel        = "control"
+	controlChannelId    uint16 = 0
+	// 65535 is reserved by RFC 8831
+	maxStreamId  uint16 = 65534
+	pingInterval        = 5 * time.Second
+	// The session is closed when no pong has come for this number of ping intervals
+	pingTimeoutIntervals = 3
+)
+
+const (
+	controlMessageTypeOpen      = "open"
+	controlMessageTypeOpened    = "opened"
+	controlMessageTypeOpenError = "open_error"
+	// "listen" asks the peer to listen and open streams to the target for accepted connections
+	controlMessageTypeListen      = "listen"
+	controlMessageTypeListened    = "listened"
+	controlMessageTypeListenError = "listen_error"
+	controlMessageTypePing        = "ping"
+	controlMessageTypePong        = "pong"
+)
+
+// Error codes of "open_error" for replies such as SOCKS5
+const (
+	openErrorCodeNotAllowed        = "not_allowed"
+	openErrorCodeHostUnreachable   = "host_unreachable"
+	openErrorCodeConnectionRefused = "connection_refused"
+)
+
+// errTargetNotAllowed is wrapped by errors of targets which the dialer does not allow
+var errTargetNotAllowed = errors.New("not allowed")
+
+type controlMessage struct {
+	Type string `json:"type"`
+	// Stream ID of "open" or request ID of "listen", and their responses
+	Id uint16 `json:"id,omitempty"`
+	// "tcp" or "udp" of "open" and "listen"
+	Network string `json:"network,omitempty"`
+	// Target of "open" to be connected by the peer. Empty means the default target.
+	// Target of "listen" is the target of "open" for accepted connections.
+	Target string `json:"target,omitempty"`
+	// [bindAddress:]port of "listen" and the actual address of "listened"
+	Address string `json:"address,omitempty"`
+	// Reason of "open_error" and "listen_error"
+	Error string `json:"error,omitempty"`
+	// Kind of the reason of "open_error" such as "not_allowed". Empty means others.
+	ErrorCode string `json:"error_code,omitempty"`
+	// Unix time in nanoseconds of "ping" and "pong"
+	Time int64 `json:"time,omitempty"`
+}
+
+// dialFunc connects to the local endpoint for a stream opened by the peer
+type dialFunc func(networkType NetworkType, target string) (net.Conn, error)
+
+// session multiplexes streams over pre-negotiated data channels of one PeerConnection
+type session struct {
+	logger         *log.Logger
+	peerConnection *webrtc.PeerConnection
+	// nil means that opening streams from the peer is not allowed
+	dial           dialFunc
+	controlChannel *webrtc.DataChannel
+	control        io.ReadWriteCloser
+	readyCh        chan struct{}
+	closedCh       chan struct{}
+	closeOnce      sync.Once
+	writeMux       sync.Mutex
+	// Offer side uses even IDs and answer side uses odd IDs not to conflict
+	streamIdsMux sync.Mutex
+	nextStreamId uint16
+	// IDs of requests and streams in use not to reuse them after wrap-around
+	usedStreamIds map[uint16]struct{}
+	pendingMux    sync.Mutex
+	// Responses of "open" and "listen"
+	pendingRequests map[uint16]chan controlMessage
+	lastPongTimeNs  int64
+	pingInterval    time.Duration
+	// Patterns of listen addresses the peer may request. Empty means "listen" is not allowed.
+	allowedListenAddresses []string
+	// Whether the peer may bind to other than loopback
+	listenGatewayPorts   bool
+	listenUnixSocketMode os.FileMode
+	listenersMux         sync.Mutex
+	listeners            []io.Closer
+}
+
+// newSession should be called before signaling so that the SDP has the data channel
+func newSession(logger *log.Logger, peerConnection *webrtc.PeerConnection, isOffer bool, dial dialFunc) (*session, error) {
+	negotiated := true
+	id := controlChannelId
+	controlChannel, err := peerConnection.CreateDataChannel(controlChannelLabel, &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var firstStreamId uint16 = 1
+	if isOffer {
+		firstStreamId = 2
+	}
+	return &session{
+		logger:          logger,
+		peerConnection:  peerConnection,
+		dial:            dial,
+		controlChannel:  controlChannel,
+		readyCh:         make(chan struct{}),
+		closedCh:        make(chan struct{}),
+		nextStreamId:    firstStreamId,
+		usedStreamIds:   map[uint16]struct{}{},
+		pendingRequests: map[uint16]chan controlMessage{},
+		pingInterval:    pingInterval,
+	}, nil
+}
+
+// run handles control messages until the control channel is closed
+func (s *session) run() error {
+	control, err := waitOpenAndDetach(s.controlChannel)
+	if err != nil {
+		return err
+	}
+	s.control = control
+	close(s.readyCh)
+	s.logger.Printf("control channel opened")
+	return s.serveControl()
+}
+
+// serveControl handles control messages until the control channel is closed or the peer stops answering pings
+func (s *session) serveControl() error {
+	atomic.StoreInt64(&s.lastPongTimeNs, time.Now().UnixNano())
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	deadCh := make(chan error, 1)
+	go s.pingLoop(doneCh, deadCh)
+
+	readErrCh := make(chan error, 1)
+	go func() {
+		readErrCh <- s.readControlMessages()
+	}()
+	var err error
+	select {
+	case err = <-readErrCh:
+	case err = <-deadCh:
+		// NOTE: The caller closes the PeerConnection and removes the session from the pool after returning
+		s.close()
+		s.control.Close()
+	}
+	s.pendingMux.Lock()
+	for id, ch := range s.pendingRequests {
+		ch <- controlMessage{Type: controlMessageTypeOpenError, Id: id, Error: "control channel closed"}
+		delete(s.pendingRequests, id)
+	}
+	s.pendingMux.Unlock()
+	return err
+}
+
+// close makes waiting openStream() fail after the PeerConnection is closed
+// It also closes the listeners requested by the peer.
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.closedCh)
+		s.listenersMux.Lock()
+		for _, listener := range s.listeners {
+			listener.Close()
+		}
+		s.listeners = nil
+		s.listenersMux.Unlock()
+	})
+}
+
+// allowListen allows "listen" from the peer for the addresses matching allowedListenAddresses
+// The peer binds to loopback only unless gatewayPorts.
+func (s *session) allowListen(allowedListenAddresses []string, gatewayPorts bool, unixSocketMode os.FileMode) {
+	s.allowedListenAddresses = allowedListenAddresses
+	s.listenGatewayPorts = gatewayPorts
+	s.listenUnixSocketMode = unixSocketMode
+}
+
+// waitConnected waits for the control channel to open in signalingTimeout. Zero means no timeout.
+func (s *session) waitConnected(signalingTimeout time.Duration) error {
+	var timeoutCh <-chan time.Time
+	if signalingTimeout != 0 {
+		timer := time.NewTimer(signalingTimeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	select {
+	case <-s.readyCh:
+		return nil
+	case <-s.closedCh:
+		return fmt.Errorf("session closed")
+	case <-timeoutCh:
+		return fmt.Errorf("peer has not connected in %s", signalingTimeout)
+	}
+}
+
+func (s *session) waitReady() error {
+	select {
+	case <-s.readyCh:
+		return nil
+	case <-s.closedCh:
+		return fmt.Errorf("session closed")
+	}
+}
+
+// newRequestId returns a new ID, which is also the stream ID of "open"
+// The ID should be released by releaseStreamId() after use. IDs in use, the control channel ID and the reserved ID are skipped.
+func (s *session) newRequestId() (uint16, error) {
+	s.streamIdsMux.Lock()
+	defer s.streamIdsMux.Unlock()
+	for i := 0; i < 1<<15; i++ {
+		id := s.nextStreamId
+		s.nextStreamId += 2
+		if id == controlChannelId || id > maxStreamId {
+			continue
+		}
+		if s.reserveStreamIdLocked(id) {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("no stream ID available")
+}
+
+// reserveStreamId reserves the ID requested by the peer and reports whether it is available
+func (s *session) reserveStreamId(id uint16) bool {
+	if id == controlChannelId || id > maxStreamId {
+		return false
+	}
+	s.streamIdsMux.Lock()
+	defer s.streamIdsMux.Unlock()
+	return s.reserveStreamIdLocked(id)
+}
+
+func (s *session) reserveStreamIdLocked(id uint16) bool {
+	if _, ok := s.usedStreamIds[id]; ok {
+		return false
+	}
+	s.usedStreamIds[id] = struct{}{}
+	return true
+}
+
+func (s *session) releaseStreamId(id uint16) {
+	s.streamIdsMux.Lock()
+	delete(s.usedStreamIds, id)
+	s.streamIdsMux.Unlock()
+}
+
+// stream releases its ID when closed
+type stream struct {
+	io.ReadWriteCloser
+	closeOnce sync.Once
+	release   func()
+}
+
+func (s *session) newStream(raw io.ReadWriteCloser, id uint16) *stream {
+	return &stream{ReadWriteCloser: raw, release: func() { s.releaseStreamId(id) }}
+}
+
+func (st *stream) Close() error {
+	err := st.ReadWriteCloser.Close()
+	st.closeOnce.Do(st.release)
+	return err
+}
+
+// request sends the request and waits for the response with the same ID
+func (s *session) request(msg controlMessage) (controlMessage, error) {
+	resCh := make(chan controlMessage, 1)
+	s.pendingMux.Lock()
+	s.pendingRequests[msg.Id] = resCh
+	s.pendingMux.Unlock()
+	if err := s.sendControlMessage(msg); err != nil {
+		s.pendingMux.Lock()
+		delete(s.pendingRequests, msg.Id)
+		s.pendingMux.Unlock()
+		return controlMessage{}, err
+	}
+	return <-resCh, nil
+}
+
+func (s *session) readControlMessages() error {
+	var buf [65536]byte
+	for {
+		n, err := s.control.Read(buf[:])
+		if err != nil {
+			return err
+		}
+		var msg controlMessage
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			s.logger.Printf("invalid control message: %+v", err)
+			continue
+		}
+		switch msg.Type {
+		case controlMessageTypeOpen:
+			go s.handleOpen(msg)
+		case controlMessageTypeListen:
+			go s.handleListen(msg)
+		case controlMessageTypeOpened, controlMessageTypeOpenError, controlMessageTypeListened, controlMessageTypeListenError:
+			s.pendingMux.Lock()
+			ch, ok := s.pendingRequests[msg.Id]
+			delete(s.pendingRequests, msg.Id)
+			s.pendingMux.Unlock()
+			if ok {
+				ch <- msg
+			}
+		case controlMessageTypePing:
+			if err := s.sendControlMessage(controlMessage{Type: controlMessageTypePong, Time: msg.Time}); err != nil {
+				return err
+			}
+		case controlMessageTypePong:
+			atomic.StoreInt64(&s.lastPongTimeNs, time.Now().UnixNano())
+			s.logger.Printf("control channel RTT: %s", time.Since(time.Unix(0, msg.Time)))
+		default:
+			s.logger.Printf("unknown control message type: %s", msg.Type)
+		}
+	}
+}
+
+// pingLoop sends pings and reports to deadCh when no pong has come for pingTimeoutIntervals
+func (s *session) pingLoop(doneCh <-chan struct{}, deadCh chan<- error) {
+	ticker := time.NewTicker(s.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-doneCh:
+			return
+		case <-ticker.C:
+		}
+		if elapsed := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastPongTimeNs))); elapsed > pingTimeoutIntervals*s.pingInterval {
+			s.logger.Printf("no pong on control channel for %s, closing the session", elapsed.Round(time.Millisecond))
+			deadCh <- fmt.Errorf("no pong on control channel for %s", elapsed.Round(time.Millisecond))
+			return
+		}
+		if err := s.sendControlMessage(controlMessage{Type: controlMessageTypePing, Time: time.Now().UnixNano()}); err != nil {
+			s.logger.Printf("failed to send ping: %+v", err)
+			return
+		}
+	}
+}
+
+func (s *session) sendControlMessage(msg controlMessage) error {
+	b, err := json.Marshal(&msg)
+	if err != nil {
+		return err
+	}
+	s.writeMux.Lock()
+	defer s.writeMux.Unlock()
+	_, err = s.control.Write(b)
+	return err
+}
+
+// openStream asks the peer to connect its local endpoint and returns the stream after the peer connected
+func (s *session) openStream(networkType NetworkType, target string) (io.ReadWriteCloser, error) {
+	if err := s.waitReady(); err != nil {
+		return nil, err
+	}
+	id, err := s.newRequestId()
+	if err != nil {
+		return nil, err
+	}
+	dataChannel, err := createStreamDataChannel(s.peerConnection, networkType, target, id)
+	if err != nil {
+		s.releaseStreamId(id)
+		return nil, err
+	}
+	res, err := s.request(controlMessage{Type: controlMessageTypeOpen, Id: id, Network: networkType.String(), Target: target})
+	if err == nil && res.Error != "" {
+		err = &openStreamError{id: id, message: res.Error, code: res.ErrorCode}
+	}
+	if err != nil {
+		_ = dataChannel.Close()
+		s.releaseStreamId(id)
+		return nil, err
+	}
+	raw, err := waitOpenAndDetach(dataChannel)
+	if err != nil {
+		s.releaseStreamId(id)
+		return nil, err
+	}
+	return s.newStream(raw, id), nil
+}
+
+// openStreamError is "open_error" from the peer
+type openStreamError struct {
+	id      uint16
+	message string
+	code    string
+}
+
+func (e *openStreamError) Error() string {
+	return fmt.Sprintf("failed to open stream %d: %s", e.id, e.message)
+}
+
+// openErrorCode classifies the error of dialing for the peer
+func openErrorCode(err error) string {
+	if errors.Is(err, errTargetNotAllowed) {
+		return openErrorCodeNotAllowed
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return openErrorCodeConnectionRefused
+	}
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	if errors.As(err, &dnsErr) || errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return openErrorCodeHostUnreachable
+	}
+	return ""
+}
+
+func (s *session) handleOpen(msg controlMessage) {
+	sendOpenError := func(err error) {
+		s.logger.Printf("failed to open stream %d: %+v", msg.Id, err)
+		if err := s.sendControlMessage(controlMessage{Type: controlMessageTypeOpenError, Id: msg.Id, Error: err.Error(), ErrorCode: openErrorCode(err)}); err != nil {
+			s.logger.Printf("failed to send open_error: %+v", err)
+		}
+	}
+	if s.dial == nil {
+		sendOpenError(fmt.Errorf("opening streams is %w", errTargetNotAllowed))
+		return
+	}
+	networkType, err := parseNetworkType(msg.Network)
+	if err != nil {
+		sendOpenError(err)
+		return
+	}
+	// NOTE: The stream ID is chosen by the peer
+	if !s.reserveStreamId(msg.Id) {
+		sendOpenError(fmt.Errorf("stream ID %d is not available", msg.Id))
+		return
+	}
+	conn, err := s.dial(networkType, msg.Target)
+	if err != nil {
+		s.releaseStreamId(msg.Id)
+		sendOpenError(err)
+		return
+	}
+	dataChannel, err := createStreamDataChannel(s.peerConnection, networkType, msg.Target, msg.Id)
+	if err != nil {
+		conn.Close()
+		s.releaseStreamId(msg.Id)
+		sendOpenError(err)
+		return
+	}
+	detached, err := waitOpenAndDetach(dataChannel)
+	if err != nil {
+		conn.Close()
+		s.releaseStreamId(msg.Id)
+		sendOpenError(err)
+		return
+	}
+	raw := s.newStream(detached, msg.Id)
+	if err := s.sendControlMessage(controlMessage{Type: controlMessageTypeOpened, Id: msg.Id}); err != nil {
+		s.logger.Printf("failed to send opened: %+v", err)
+		conn.Close()
+		raw.Close()
+		return
+	}
+	s.logger.Printf("stream %d opened: %s %s", msg.Id, networkType, msg.Target)
+	switch networkType {
+	case NetworkTypeTcp:
+		pipe(conn, raw)
+	case NetworkTypeUdp:
+		pipeUdp(s.logger, conn, raw)
+	}
+}
+
+// createStreamDataChannel creates a pre-negotiated data channel, which needs no in-band open
+// Both sides create a data channel with the same ID and options. The label is tagged with the target.
+func createStreamDataChannel(peerConnection *webrtc.PeerConnection, networkType NetworkType, target string, id uint16) (*webrtc.DataChannel, error) {
+	negotiated := true
+	options := webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &id,
+	}
+	if networkType == NetworkTypeUdp {
+		var ordered = false
+		var maxRetransmits uint16 = 0
+		options.Ordered = &ordered
+		options.MaxRetransmits = &maxRetransmits
+	}
+	label := "data"
+	if target != "" {
+		label = "data:" + target
+	}
+	return peerConnection.CreateDataChannel(label, &options)
+}
+
+func waitOpenAndDetach(dataChannel *webrtc.DataChannel) (io.ReadWriteCloser, error) {
+	openedCh := make(chan struct{})
+	closedCh := make(chan struct{})
+	var openOnce, closeOnce sync.Once
+	dataChannel.OnOpen(func() {
+		openOnce.Do(func() { close(openedCh) })
+	})
+	dataChannel.OnClose(func() {
+		closeOnce.Do(func() { close(closedCh) })
+	})
+	select {
+	case <-openedCh:
+		return dataChannel.Detach()
+	case <-closedCh:
+		return nil, fmt.Errorf("data channel closed before open")
+	}
+}
+
+// pipe copies both directions and closes both after both directions finish
+// EOF of each side is sent as an empty message and becomes CloseWrite() on the other side, so half-close works.
+// Any error closes both immediately.
+func pipe(conn net.Conn, raw io.ReadWriteCloser) {
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			conn.Close()
+			raw.Close()
+		})
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := copyToStream(raw, conn); err != nil {
+			closeBoth()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := copyFromStream(conn, raw); err != nil {
+			closeBoth()
+			return
+		}
+		if err := closeWrite(conn); err != nil {
+			closeBoth()
+		}
+	}()
+	go func() {
+		wg.Wait()
+		closeBoth()
+	}()
+}
+
+// copyToStream copies until EOF and sends an empty message as FIN
+func copyToStream(raw io.Writer, conn io.Reader) error {
+	var buf [32 * 1024]byte // same size as io.Copy()
+	for {
+		n, err := conn.Read(buf[:])
+		if n != 0 {
+			if _, err := raw.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			_, err = raw.Write([]byte{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// copyFromStream copies until an empty message, FIN
+// The stream closed without FIN is an error.
+func copyFromStream(conn io.Writer, raw io.Reader) error {
+	var buf [64 * 1024]byte
+	for {
+		n, err := raw.Read(buf[:])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+// closeWrite shuts down the writing side of *net.TCPConn and *net.UnixConn
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return fmt.Errorf("half-close is not supported: %T", conn)
+}
+
+// pipeUdp copies each datagram as one message and closes both when either direction ends
+func pipeUdp(logger *log.Logger, conn net.Conn, raw io.ReadWriteCloser) {
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			conn.Close()
+			raw.Close()
+		})
+	}
+	go func() {
+		defer closeBoth()
+		var buf [65536]byte
+		if _, err := io.CopyBuffer(raw, conn, buf[:]); err != nil {
+			logger.Printf("failed to copy UDP to data channel: %+v", err)
+		}
+	}()
+	go func() {
+		defer closeBoth()
+		var buf [65536]byte
+		if _, err := io.CopyBuffer(conn, raw, buf[:]); err != nil {
+			logger.Printf("failed to copy data channel to UDP: %+v", err)
+		}
+	}()
+}
+
+// sessionPool holds the sessions of connected peers
+// There are multiple sessions when peers join a hub.
+type sessionPool struct {
+	mux      sync.Mutex
+	cond     *sync.Cond
+	sessions []*session
+	next     int
+}
+
+func newSessionPool() *sessionPool {
+	pool := &sessionPool{}
+	pool.cond = sync.NewCond(&pool.mux)
+	return pool
+}
+
+// add adds the session unless it has been closed
+// NOTE: Checking under the lock keeps a session closed and removed concurrently out of the pool
+func (p *sessionPool) add(session *session) {
+	p.mux.Lock()
+	select {
+	case <-session.closedCh:
+		p.mux.Unlock()
+		return
+	default:
+	}
+	p.sessions = append(p.sessions, session)
+	p.mux.Unlock()
+	p.cond.Broadcast()
+}
+
+func (p *sessionPool) remove(session *session) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for i, s := range p.sessions {
+		if s == session {
+			p.sessions = append(p.sessions[:i], p.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// get waits for a session and returns sessions in round-robin
+func (p *sessionPool) get() *session {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for len(p.sessions) == 0 {
+		p.cond.Wait()
+	}
+	p.next = (p.next + 1) % len(p.sessions)
+	return p.sessions[p.next]
+}
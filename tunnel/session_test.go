@@ -0,0 +1,149 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNewRequestIdSkipsReservedAndUsedIds(t *testing.T) {
+	tests := []struct {
+		name          string
+		nextStreamId  uint16
+		usedStreamIds []uint16
+		expected      []uint16
+	}{
+		{name: "offer side", nextStreamId: 65532, usedStreamIds: []uint16{2}, expected: []uint16{65532, 65534, 4, 6}},
+		{name: "answer side", nextStreamId: 65533, usedStreamIds: []uint16{3}, expected: []uint16{65533, 1, 5, 7}},
+	}
+	for _, test := range tests {
+		s := &session{nextStreamId: test.nextStreamId, usedStreamIds: map[uint16]struct{}{}}
+		for _, id := range test.usedStreamIds {
+			s.usedStreamIds[id] = struct{}{}
+		}
+		for _, expected := range test.expected {
+			id, err := s.newRequestId()
+			if err != nil {
+				t.Fatalf("%s: newRequestId() error: %v", test.name, err)
+			}
+			if id != expected {
+				t.Errorf("%s: newRequestId() = %d, want %d", test.name, id, expected)
+			}
+		}
+	}
+}
+
+func TestNewRequestIdExhausted(t *testing.T) {
+	s := &session{nextStreamId: 2, usedStreamIds: map[uint16]struct{}{}}
+	for id := 2; id <= int(maxStreamId); id += 2 {
+		s.usedStreamIds[uint16(id)] = struct{}{}
+	}
+	if _, err := s.newRequestId(); err == nil {
+		t.Errorf("newRequestId() should fail when all IDs are in use")
+	}
+	s.releaseStreamId(100)
+	id, err := s.newRequestId()
+	if err != nil || id != 100 {
+		t.Errorf("newRequestId() = %d, %v, want 100", id, err)
+	}
+}
+
+func TestReserveStreamId(t *testing.T) {
+	s := &session{usedStreamIds: map[uint16]struct{}{}}
+	if s.reserveStreamId(controlChannelId) {
+		t.Errorf("control channel ID should not be reserved")
+	}
+	if s.reserveStreamId(65535) {
+		t.Errorf("65535 should not be reserved")
+	}
+	if !s.reserveStreamId(3) {
+		t.Errorf("3 should be reserved")
+	}
+	if s.reserveStreamId(3) {
+		t.Errorf("3 in use should not be reserved")
+	}
+}
+
+func TestServeControlClosesSessionWithoutPong(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	// NOTE: The peer reads pings but never answers
+	go io.Copy(io.Discard, remote)
+	s := &session{
+		logger:          log.New(io.Discard, "", 0),
+		control:         local,
+		closedCh:        make(chan struct{}),
+		pendingRequests: map[uint16]chan controlMessage{},
+		pingInterval:    10 * time.Millisecond,
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.serveControl()
+	}()
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Errorf("serveControl() should fail without pong")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("serveControl() should return without pong")
+	}
+	select {
+	case <-s.closedCh:
+	default:
+		t.Errorf("session should be closed")
+	}
+	if _, err := s.openStream(NetworkTypeTcp, ""); err == nil {
+		t.Errorf("openStream() should fail on the closed session")
+	}
+}
+
+func TestSessionPoolAddSkipsClosedSession(t *testing.T) {
+	pool := newSessionPool()
+	closed := &session{closedCh: make(chan struct{})}
+	closed.close()
+	pool.add(closed)
+	if len(pool.sessions) != 0 {
+		t.Errorf("closed session should not be added")
+	}
+	opened := &session{closedCh: make(chan struct{})}
+	pool.add(opened)
+	if pool.get() != opened {
+		t.Errorf("get() should return the opened session")
+	}
+	pool.remove(opened)
+	if len(pool.sessions) != 0 {
+		t.Errorf("removed session should not be in the pool")
+	}
+}
+
+func TestOpenErrorCode(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	closedAddress := ln.Addr().String()
+	ln.Close()
+	_, refusedErr := net.Dial("tcp", closedAddress)
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{name: "not allowed", err: fmt.Errorf("tcp db:5432 is %w", errTargetNotAllowed), expected: openErrorCodeNotAllowed},
+		{name: "refused", err: refusedErr, expected: openErrorCodeConnectionRefused},
+		{name: "DNS", err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "unknown.invalid", IsNotFound: true}}, expected: openErrorCodeHostUnreachable},
+		{name: "unreachable", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, expected: openErrorCodeHostUnreachable},
+		{name: "other", err: fmt.Errorf("target is required"), expected: ""},
+	}
+	for _, test := range tests {
+		if actual := openErrorCode(test.err); actual != test.expected {
+			t.Errorf("%s: openErrorCode(%v) = %q, want %q", test.name, test.err, actual, test.expected)
+		}
+	}
+}
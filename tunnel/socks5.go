@@ -0,0 +1,323 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SOCKS5 (RFC 1928) without authentication
+// Each CONNECT opens a stream with the requested destination as its target.
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodNoAcceptable = 0xff
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUdpAssociate = 0x03
+
+	socks5AtypIpv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIpv6   = 0x04
+
+	socks5ReplySucceeded           = 0x00
+	socks5ReplyGeneralFailure      = 0x01
+	socks5ReplyNotAllowed          = 0x02
+	socks5ReplyHostUnreachable     = 0x04
+	socks5ReplyConnectionRefused   = 0x05
+	socks5ReplyCommandNotSupported = 0x07
+	socks5ReplyAtypNotSupported    = 0x08
+)
+
+// socks5HandshakeTimeout limits the method selection and the request from the client
+const socks5HandshakeTimeout = 10 * time.Second
+
+func socks5Listener(logger *log.Logger, pool *sessionPool, ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		logger.Printf("accepted SOCKS5")
+		go func() {
+			if err := handleSocks5(logger, pool, conn); err != nil {
+				logger.Printf("SOCKS5 error: %+v", err)
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func handleSocks5(logger *log.Logger, pool *sessionPool, conn net.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout)); err != nil {
+		return err
+	}
+	// Method selection
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	method := byte(socks5MethodNoAcceptable)
+	for _, m := range methods {
+		if m == socks5MethodNoAuth {
+			method = socks5MethodNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	if method == socks5MethodNoAcceptable {
+		return fmt.Errorf("no acceptable authentication method")
+	}
+
+	// Request
+	// VER CMD RSV
+	var request [3]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return err
+	}
+	if request[0] != socks5Version || request[2] != 0 {
+		_ = writeSocks5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return fmt.Errorf("invalid SOCKS5 request: version=%d, reserved=%d", request[0], request[2])
+	}
+	target, err := readSocks5Address(conn)
+	if err != nil {
+		_ = writeSocks5Reply(conn, socks5ReplyAtypNotSupported, nil)
+		return err
+	}
+	// NOTE: Opening a stream may wait for a peer longer than the handshake timeout
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	switch request[1] {
+	case socks5CmdConnect:
+		raw, err := pool.get().openStream(NetworkTypeTcp, target)
+		if err != nil {
+			_ = writeSocks5Reply(conn, socks5ReplyCode(err), nil)
+			return err
+		}
+		if err := writeSocks5Reply(conn, socks5ReplySucceeded, nil); err != nil {
+			raw.Close()
+			return err
+		}
+		pipe(conn, raw)
+		return nil
+	case socks5CmdUdpAssociate:
+		return handleSocks5UdpAssociate(logger, pool, conn, target)
+	default:
+		_ = writeSocks5Reply(conn, socks5ReplyCommandNotSupported, nil)
+		return fmt.Errorf("unsupported SOCKS5 command: %d", request[1])
+	}
+}
+
+// socks5ReplyCode returns the reply for the error of opening a stream
+func socks5ReplyCode(err error) byte {
+	var openErr *openStreamError
+	if !errors.As(err, &openErr) {
+		return socks5ReplyGeneralFailure
+	}
+	switch openErr.code {
+	case openErrorCodeNotAllowed:
+		return socks5ReplyNotAllowed
+	case openErrorCodeHostUnreachable:
+		return socks5ReplyHostUnreachable
+	case openErrorCodeConnectionRefused:
+		return socks5ReplyConnectionRefused
+	}
+	return socks5ReplyGeneralFailure
+}
+
+// readSocks5Address reads ATYP, DST.ADDR and DST.PORT and returns "host:port"
+func readSocks5Address(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AtypIpv4, socks5AtypIpv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socks5AtypIpv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unsupported SOCKS5 address type: %d", atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// appendSocks5Address appends ATYP, ADDR and PORT of "host:port"
+func appendSocks5Address(b []byte, address string) []byte {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return append(b, socks5AtypIpv4, 0, 0, 0, 0, 0, 0)
+	}
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+	if ip := net.ParseIP(host); ip == nil {
+		b = append(b, socks5AtypDomain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AtypIpv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AtypIpv6)
+		b = append(b, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// writeSocks5Reply writes a reply with the bound address, which is 0.0.0.0:0 when addr is nil
+func writeSocks5Reply(w io.Writer, reply byte, addr net.Addr) error {
+	b := []byte{socks5Version, reply, 0x00}
+	if addr == nil {
+		b = appendSocks5Address(b, "0.0.0.0:0")
+	} else {
+		b = appendSocks5Address(b, addr.String())
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// handleSocks5UdpAssociate relays datagrams until the TCP connection is closed
+// Each destination has its own unordered stream. Only datagrams from the IP address of the TCP client are relayed,
+// and only from the port declared in the request unless it is zero.
+func handleSocks5UdpAssociate(logger *log.Logger, pool *sessionPool, conn net.Conn, declaredAddress string) error {
+	// NOTE: UDP ASSOCIATE needs the IP address of the TCP listener, which a Unix domain socket does not have
+	tcpLocalAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		_ = writeSocks5Reply(conn, socks5ReplyCommandNotSupported, nil)
+		return fmt.Errorf("UDP ASSOCIATE is not supported on %s", conn.LocalAddr().Network())
+	}
+	tcpRemoteAddr := conn.RemoteAddr().(*net.TCPAddr)
+	_, declaredPortStr, _ := net.SplitHostPort(declaredAddress)
+	declaredPort, _ := strconv.Atoi(declaredPortStr)
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: tcpLocalAddr.IP, Zone: tcpLocalAddr.Zone})
+	if err != nil {
+		_ = writeSocks5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return err
+	}
+	if err := writeSocks5Reply(conn, socks5ReplySucceeded, udpConn.LocalAddr()); err != nil {
+		udpConn.Close()
+		return err
+	}
+
+	var streamsMux sync.Mutex
+	streams := map[string]io.ReadWriteCloser{}
+	go func() {
+		// NOTE: The association terminates when the TCP connection is closed
+		_, _ = io.Copy(io.Discard, conn)
+		conn.Close()
+		udpConn.Close()
+		streamsMux.Lock()
+		for _, stream := range streams {
+			stream.Close()
+		}
+		streamsMux.Unlock()
+	}()
+
+	var clientAddr *net.UDPAddr
+	var buf [65536]byte
+	for {
+		n, raddr, err := udpConn.ReadFromUDP(buf[:])
+		if err != nil {
+			return nil
+		}
+		if !raddr.IP.Equal(tcpRemoteAddr.IP) || (declaredPort != 0 && raddr.Port != declaredPort) {
+			logger.Printf("ignored SOCKS5 UDP from %s", raddr)
+			continue
+		}
+		// NOTE: Only the first client is accepted
+		if clientAddr == nil {
+			clientAddr = raddr
+		} else if clientAddr.String() != raddr.String() {
+			continue
+		}
+		// RSV(2) FRAG(1)
+		if n < 3 || buf[2] != 0 {
+			logger.Printf("fragmented SOCKS5 UDP is not supported")
+			continue
+		}
+		reader := bytes.NewReader(buf[3:n])
+		target, err := readSocks5Address(reader)
+		if err != nil {
+			logger.Printf("invalid SOCKS5 UDP header: %+v", err)
+			continue
+		}
+		streamsMux.Lock()
+		stream, ok := streams[target]
+		streamsMux.Unlock()
+		if !ok {
+			stream, err = pool.get().openStream(NetworkTypeUdp, target)
+			if err != nil {
+				logger.Printf("failed to open stream: %+v", err)
+				continue
+			}
+			streamsMux.Lock()
+			streams[target] = stream
+			streamsMux.Unlock()
+			go func(target string, stream io.ReadWriteCloser) {
+				header := appendSocks5Address([]byte{0, 0, 0}, target)
+				var buf [65536]byte
+				for {
+					n, err := stream.Read(buf[len(header):])
+					if err != nil {
+						streamsMux.Lock()
+						// NOTE: The stream may have been replaced with a new stream after a failed write
+						if streams[target] == stream {
+							delete(streams, target)
+						}
+						streamsMux.Unlock()
+						return
+					}
+					copy(buf[:], header)
+					if _, err := udpConn.WriteToUDP(buf[:len(header)+n], clientAddr); err != nil {
+						logger.Printf("failed to write to UDP: %+v", err)
+					}
+				}
+			}(target, stream)
+		}
+		if _, err := stream.Write(buf[n-reader.Len() : n]); err != nil {
+			// NOTE: The next datagram opens a new stream
+			logger.Printf("failed to write to stream: %+v", err)
+			streamsMux.Lock()
+			if streams[target] == stream {
+				delete(streams, target)
+			}
+			streamsMux.Unlock()
+			stream.Close()
+		}
+	}
+}
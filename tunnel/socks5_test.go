@@ -0,0 +1,25 @@
+package tunnel
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSocks5ReplyCode(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected byte
+	}{
+		{err: &openStreamError{code: openErrorCodeNotAllowed}, expected: socks5ReplyNotAllowed},
+		{err: &openStreamError{code: openErrorCodeHostUnreachable}, expected: socks5ReplyHostUnreachable},
+		{err: &openStreamError{code: openErrorCodeConnectionRefused}, expected: socks5ReplyConnectionRefused},
+		// NOTE: Other errors of the peer have no code
+		{err: &openStreamError{}, expected: socks5ReplyGeneralFailure},
+		{err: fmt.Errorf("session closed"), expected: socks5ReplyGeneralFailure},
+	}
+	for _, test := range tests {
+		if actual := socks5ReplyCode(test.err); actual != test.expected {
+			t.Errorf("socks5ReplyCode(%#v) = %d, want %d", test.err, actual, test.expected)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// unixPrefix is the prefix of Unix domain socket addresses such as "unix:/var/run/docker.sock"
+const unixPrefix = "unix:"
+
+// listenStream listens on the TCP port or the Unix domain socket of the forward
+func (f Forward) listenStream() (net.Listener, error) {
+	if f.UnixSocketPath == "" {
+		return net.Listen("tcp", f.localAddress())
+	}
+	return listenUnix(f.UnixSocketPath, f.UnixSocketMode)
+}
+
+// listenUnix removes the stale socket file and listens on the Unix domain socket
+// The abstract socket, "@" prefix, has no file.
+func listenUnix(unixSocketPath string, mode os.FileMode) (net.Listener, error) {
+	abstract := strings.HasPrefix(unixSocketPath, "@")
+	if !abstract {
+		if err := removeStaleUnixSocket(unixSocketPath); err != nil {
+			return nil, err
+		}
+	}
+	if abstract || mode == 0 {
+		return net.Listen("unix", unixSocketPath)
+	}
+	return listenUnixWithMode(unixSocketPath, mode)
+}
+
+// listenUnixWithMode binds in a private directory and links the socket into place
+// NOTE: chmod after binding at the path leaves a window where others can connect with the permissions by umask
+func listenUnixWithMode(unixSocketPath string, mode os.FileMode) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(unixSocketPath), ".webrtc-piping")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := filepath.Join(dir, "s")
+	ln, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: The socket file is removed by unixListener.Close() because it is linked to the other path
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	// NOTE: Link() does not replace a file created after removing the stale socket unlike Rename()
+	if err := os.Link(tmpPath, unixSocketPath); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{Listener: ln, addr: &net.UnixAddr{Name: unixSocketPath, Net: "unix"}}, nil
+}
+
+// unixListener is a listener linked to addr
+type unixListener struct {
+	net.Listener
+	addr      *net.UnixAddr
+	closeOnce sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() {
+		_ = os.Remove(l.addr.Name)
+	})
+	return err
+}
+
+// removeStaleUnixSocket removes the socket file left by the process which has gone
+func removeStaleUnixSocket(unixSocketPath string) error {
+	info, err := os.Lstat(unixSocketPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", unixSocketPath)
+	}
+	if conn, err := net.Dial("unix", unixSocketPath); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", unixSocketPath)
+	}
+	return os.Remove(unixSocketPath)
+}
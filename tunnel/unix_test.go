@@ -0,0 +1,39 @@
+package tunnel
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixWithMode(t *testing.T) {
+	dir := t.TempDir()
+	unixSocketPath := filepath.Join(dir, "test.sock")
+	ln, err := listenUnix(unixSocketPath, 0600)
+	if err != nil {
+		t.Fatalf("listenUnix() error: %v", err)
+	}
+	info, err := os.Lstat(unixSocketPath)
+	if err != nil {
+		t.Fatalf("Lstat() error: %v", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want socket with 0600", info.Mode())
+	}
+	if ln.Addr().String() != unixSocketPath {
+		t.Errorf("Addr() = %s, want %s", ln.Addr(), unixSocketPath)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() error: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary directory should be removed: %v", entries)
+	}
+	if err := ln.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+	if _, err := os.Lstat(unixSocketPath); !os.IsNotExist(err) {
+		t.Errorf("socket file should be removed on close: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package turn_server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"github.com/pion/turn/v2"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Serve runs a TURN server on both UDP and TCP until SIGINT or SIGTERM
+// minRelayPort and maxRelayPort of 0 mean any port
+// Peers of loopback, private and link-local addresses are denied unless allowsPrivatePeers.
+func Serve(logger *log.Logger, listenAddress string, realm string, relayIp net.IP, users map[string]string, authSecret string, minRelayPort uint16, maxRelayPort uint16, allowsPrivatePeers bool) error {
+	udpConn, err := net.ListenPacket("udp", listenAddress)
+	if err != nil {
+		return err
+	}
+	tcpListener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return err
+	}
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       realm,
+		AuthHandler: authHandler(logger, users, authSecret),
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            udpConn,
+				RelayAddressGenerator: relayAddressGenerator(relayIp, minRelayPort, maxRelayPort),
+				PermissionHandler:     permissionHandler(logger, allowsPrivatePeers),
+			},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{
+				Listener:              tcpListener,
+				RelayAddressGenerator: relayAddressGenerator(relayIp, minRelayPort, maxRelayPort),
+				PermissionHandler:     permissionHandler(logger, allowsPrivatePeers),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	<-signalCh
+	return server.Close()
+}
+
+func relayAddressGenerator(relayIp net.IP, minRelayPort uint16, maxRelayPort uint16) turn.RelayAddressGenerator {
+	if minRelayPort == 0 && maxRelayPort == 0 {
+		return &turn.RelayAddressGeneratorStatic{
+			RelayAddress: relayIp,
+			Address:      "0.0.0.0",
+		}
+	}
+	return &turn.RelayAddressGeneratorPortRange{
+		RelayAddress: relayIp,
+		MinPort:      minRelayPort,
+		MaxPort:      maxRelayPort,
+		Address:      "0.0.0.0",
+	}
+}
+
+// permissionHandler denies relaying to internal addresses not to be used for SSRF
+func permissionHandler(logger *log.Logger, allowsPrivatePeers bool) turn.PermissionHandler {
+	return func(clientAddr net.Addr, peerIp net.IP) bool {
+		if allowsPrivatePeers || isPublicPeer(peerIp) {
+			return true
+		}
+		logger.Printf("denied peer: peer=%s, clientAddr=%s", peerIp, clientAddr)
+		return false
+	}
+}
+
+// isPublicPeer reports whether the peer is not loopback, private, link-local, multicast nor unspecified
+func isPublicPeer(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// authHandler accepts static users and time-limited users of TURN REST API
+func authHandler(logger *log.Logger, users map[string]string, authSecret string) turn.AuthHandler {
+	return func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+		if password, ok := users[username]; ok {
+			logger.Printf("authenticated: username=%s, srcAddr=%s", username, srcAddr)
+			return turn.GenerateAuthKey(username, realm, password), true
+		}
+		if authSecret == "" {
+			logger.Printf("unknown user: username=%s, srcAddr=%s", username, srcAddr)
+			return nil, false
+		}
+		// username is "<expiry unix time>" or "<expiry unix time>:<user>"
+		expiry, err := strconv.ParseInt(strings.SplitN(username, ":", 2)[0], 10, 64)
+		if err != nil {
+			logger.Printf("invalid time-limited username: username=%s, srcAddr=%s", username, srcAddr)
+			return nil, false
+		}
+		if expiry < time.Now().Unix() {
+			logger.Printf("expired username: username=%s, srcAddr=%s", username, srcAddr)
+			return nil, false
+		}
+		mac := hmac.New(sha1.New, []byte(authSecret))
+		mac.Write([]byte(username))
+		password := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		logger.Printf("authenticated: username=%s, srcAddr=%s", username, srcAddr)
+		return turn.GenerateAuthKey(username, realm, password), true
+	}
+}
+
+// DetectDefaultRouteIp returns the source IP address of the default route without sending any packets
+// NOTE: It is a private IP address behind NAT
+func DetectDefaultRouteIp() (net.IP, error) {
+	conn, err := net.Dial("udp", "8.8.8.8:53")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	udpAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected local address: %s", conn.LocalAddr())
+	}
+	return udpAddr.IP, nil
+}
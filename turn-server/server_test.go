@@ -0,0 +1,34 @@
+package turn_server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPublicPeer(t *testing.T) {
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{ip: "8.8.8.8", expected: true},
+		{ip: "2001:4860:4860::8888", expected: true},
+		{ip: "127.0.0.1", expected: false},
+		{ip: "::1", expected: false},
+		{ip: "10.0.0.1", expected: false},
+		{ip: "172.16.0.1", expected: false},
+		{ip: "192.168.1.1", expected: false},
+		{ip: "fd00::1", expected: false},
+		{ip: "169.254.169.254", expected: false},
+		{ip: "fe80::1", expected: false},
+		{ip: "0.0.0.0", expected: false},
+		{ip: "::", expected: false},
+		{ip: "224.0.0.1", expected: false},
+		{ip: "::ffff:127.0.0.1", expected: false},
+		{ip: "::ffff:8.8.8.8", expected: true},
+	}
+	for _, test := range tests {
+		if actual := isPublicPeer(net.ParseIP(test.ip)); actual != test.expected {
+			t.Errorf("isPublicPeer(%s) = %v, want %v", test.ip, actual, test.expected)
+		}
+	}
+}